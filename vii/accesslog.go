@@ -0,0 +1,221 @@
+package vii
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=====================================
+// access logging
+//=====================================
+
+// LogFormat selects the output format of LoggerWithConfig.
+type LogFormat int
+
+const (
+	// LogFormatStructured writes one slog record per request.
+	LogFormatStructured LogFormat = iota
+	// LogFormatCommon writes Apache Common Log Format lines to Output.
+	LogFormatCommon
+	// LogFormatCombined writes Apache Combined Log Format lines to Output.
+	LogFormatCombined
+)
+
+// DefaultLogFields are the fields logged by LogFormatStructured when
+// LoggerConfig.Fields is empty. "query", "host", "proto", "referer" and
+// "user_agent" are also available.
+var DefaultLogFields = []string{"method", "path", "status", "bytes", "duration", "ip", "request_id"}
+
+// LoggerConfig holds the configuration for LoggerWithConfig.
+type LoggerConfig struct {
+	Format LogFormat
+	// Logger receives structured records. Defaults to slog.Default().
+	Logger *slog.Logger
+	// Level is used for requests that don't end in a 5xx, which are always
+	// logged at slog.LevelError. Defaults to slog.LevelInfo.
+	Level slog.Level
+	// Fields lists the attributes of each structured record, in order.
+	Fields []string
+	// Output receives Common and Combined log lines. Defaults to os.Stdout.
+	Output io.Writer
+	// SkipPaths lists exact request paths, such as health checks, to skip.
+	SkipPaths []string
+	// Skip, if set, is called for every request; returning true skips it.
+	Skip func(r *http.Request) bool
+	// TrustedProxies lists proxies whose forwarding headers are used for the
+	// client IP, as in RateLimiterConfig.
+	TrustedProxies []string
+	// RequestIDHeader is read for the request_id field. Defaults to X-Request-ID.
+	RequestIDHeader string
+}
+
+// LoggerWithConfig returns an access logging middleware that records the
+// response status, body size, client IP and request ID of every request.
+func LoggerWithConfig(config LoggerConfig) func(http.Handler) http.Handler {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	if len(config.Fields) == 0 {
+		config.Fields = DefaultLogFields
+	}
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+	if config.RequestIDHeader == "" {
+		config.RequestIDHeader = "X-Request-ID"
+	}
+	trusted, err := ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		panic("vii: invalid LoggerConfig.TrustedProxies: " + err.Error())
+	}
+	var outputMu sync.Mutex
+
+	logRequest := func(r *http.Request, rw *responseWriter, start time.Time) {
+		entry := accessLogEntry{
+			r:         r,
+			rw:        rw,
+			start:     start,
+			duration:  time.Since(start),
+			ip:        ClientIP(r, trusted),
+			requestID: r.Header.Get(config.RequestIDHeader),
+		}
+
+		switch config.Format {
+		case LogFormatCommon, LogFormatCombined:
+			line := entry.commonLogLine(config.Format == LogFormatCombined)
+			outputMu.Lock()
+			io.WriteString(config.Output, line)
+			outputMu.Unlock()
+		default:
+			level := config.Level
+			if rw.status >= 500 {
+				level = slog.LevelError
+			}
+			config.Logger.LogAttrs(r.Context(), level, "request", entry.attrs(config.Fields)...)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(config.SkipPaths, r.URL.Path) || (config.Skip != nil && config.Skip(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			rw := newResponseWriter(w)
+			completed := false
+			// Logging is deferred so a request whose handler panics is still
+			// logged, as a 500 unless a response was already started.
+			defer func() {
+				if !completed && !rw.wroteHeader {
+					rw.status = http.StatusInternalServerError
+				}
+				logRequest(r, rw, start)
+			}()
+			next.ServeHTTP(rw, r)
+			completed = true
+		})
+	}
+}
+
+type accessLogEntry struct {
+	r         *http.Request
+	rw        *responseWriter
+	start     time.Time
+	duration  time.Duration
+	ip        string
+	requestID string
+}
+
+func (e accessLogEntry) attrs(fields []string) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, field := range fields {
+		switch field {
+		case "method":
+			attrs = append(attrs, slog.String("method", e.r.Method))
+		case "path":
+			attrs = append(attrs, slog.String("path", e.r.URL.Path))
+		case "query":
+			attrs = append(attrs, slog.String("query", e.r.URL.RawQuery))
+		case "status":
+			attrs = append(attrs, slog.Int("status", e.rw.status))
+		case "bytes":
+			attrs = append(attrs, slog.Int("bytes", e.rw.bytes))
+		case "duration":
+			attrs = append(attrs, slog.Duration("duration", e.duration))
+		case "ip":
+			attrs = append(attrs, slog.String("ip", e.ip))
+		case "request_id":
+			attrs = append(attrs, slog.String("request_id", e.requestID))
+		case "host":
+			attrs = append(attrs, slog.String("host", e.r.Host))
+		case "proto":
+			attrs = append(attrs, slog.String("proto", e.r.Proto))
+		case "referer":
+			attrs = append(attrs, slog.String("referer", e.r.Referer()))
+		case "user_agent":
+			attrs = append(attrs, slog.String("user_agent", e.r.UserAgent()))
+		}
+	}
+	return attrs
+}
+
+// commonLogLine formats the entry in Apache Common Log Format, optionally
+// extended with the referer and user agent of Combined Log Format.
+func (e accessLogEntry) commonLogLine(combined bool) string {
+	user := "-"
+	if name, _, ok := e.r.BasicAuth(); ok && name != "" {
+		user = clfEscape(name)
+	}
+	size := "-"
+	if e.rw.bytes > 0 {
+		size = strconv.Itoa(e.rw.bytes)
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s\" %d %s",
+		e.ip,
+		user,
+		e.start.Format("02/Jan/2006:15:04:05 -0700"),
+		clfEscape(e.r.Method+" "+e.r.URL.RequestURI()+" "+e.r.Proto),
+		e.rw.status,
+		size,
+	)
+	if combined {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", clfValue(e.r.Referer()), clfValue(e.r.UserAgent()))
+	}
+	return line + "\n"
+}
+
+func clfValue(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "-"
+	}
+	return clfEscape(s)
+}
+
+// clfEscape escapes a quoted log field the way Apache does: quotes and
+// backslashes get a backslash, and control bytes become \xhh. Other bytes,
+// including UTF-8, are written as they are.
+func clfEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
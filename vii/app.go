@@ -1,8 +1,11 @@
 package vii
 
 import (
-	"fmt"
+	"context"
+	"io/fs"
+	"net"
 	"net/http"
+	"sync"
 )
 
 const VII_CONTEXT = "VII_CONTEXT"
@@ -12,6 +15,16 @@ type App struct {
 	GlobalContext    map[string]any
 	GlobalMiddleware []func(http.Handler) http.Handler
 	globalChain      http.Handler
+	routes           []*Route
+	namedRoutes      map[string]*Route
+	errorHandler     func(http.ResponseWriter, *http.Request, error)
+	server           *http.Server
+	listener         net.Listener
+	stopping         bool // set by Shutdown, even before the server starts
+	serverMu         sync.Mutex
+	startHooks       []func() error
+	shutdownHooks    []func(ctx context.Context) error
+	watched          []fs.FS
 }
 
 func NewApp() *App {
@@ -20,6 +33,7 @@ func NewApp() *App {
 		Mux:              mux,
 		GlobalContext:    make(map[string]any),
 		GlobalMiddleware: []func(http.Handler) http.Handler{},
+		namedRoutes:      make(map[string]*Route),
 	}
 	return app
 }
@@ -32,23 +46,43 @@ func (app *App) SetContext(key string, value any) {
 	app.GlobalContext[key] = value
 }
 
-func (app *App) Handle(path string, handler http.HandlerFunc, middleware ...func(http.Handler) http.Handler) {
+// Handle registers a handler for a ServeMux pattern such as "GET /users/{id}".
+// Pass an http.Handler as h.ServeHTTP. The returned Route can be named for
+// URL generation.
+func (app *App) Handle(path string, handler http.HandlerFunc, middleware ...func(http.Handler) http.Handler) *Route {
+	return app.handle(path, handler, nil, middleware)
+}
+
+// HandleErr registers a handler that returns an error, which is passed to
+// the app's error handler.
+func (app *App) HandleErr(path string, handler HandlerFunc, middleware ...func(http.Handler) http.Handler) *Route {
+	return app.handle(path, app.errorHandlerFunc(handler), nil, middleware)
+}
+
+// HandleTyped registers a handler created by JSONHandler. Its request and
+// response types are documented by OpenAPI.
+func (app *App) HandleTyped(path string, handler *TypedHandler, middleware ...func(http.Handler) http.Handler) *Route {
+	return app.handle(path, app.errorHandlerFunc(handler.Handler), handler, middleware)
+}
+
+func (app *App) handle(path string, handler http.HandlerFunc, typed *TypedHandler, middleware []func(http.Handler) http.Handler) *Route {
 	finalHandler := Chain(handler, middleware...)
+	// The route is complete before the mux can serve it, as the handler
+	// reads it.
+	rt := app.addRoute(path, nil, middleware)
+	rt.typed = typed
 	app.Mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 		r = SetContext("GLOBAL", app.GlobalContext, r)
+		r = rt.withLayout(r)
 		// Only apply Local middleware here
 		finalHandler.ServeHTTP(w, r)
 	})
+	return rt
 }
 
+// Serve starts the server on the given port with the default ServerConfig.
 func (app *App) Serve(port string) error {
-	app.globalChain = Chain(app.Mux.ServeHTTP, app.GlobalMiddleware...)
-	fmt.Println("starting server on port " + port + " 🚀")
-	err := http.ListenAndServe(":"+port, app)
-	if err != nil {
-		return err
-	}
-	return nil
+	return app.ServeWithConfig(ServerConfig{Addr: ":" + port})
 }
 
 func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
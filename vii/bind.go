@@ -0,0 +1,274 @@
+package vii
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//=====================================
+// binding
+//=====================================
+
+// bindSources lists the struct tags Bind reads, in the order they are tried.
+var bindSources = []string{"path", "query", "form", "header", "cookie"}
+
+// FieldError describes a single field that failed to bind or validate.
+type FieldError struct {
+	Field   string `json:"field"`
+	Source  string `json:"source,omitempty"` // Bind source, e.g. "query".
+	Rule    string `json:"rule,omitempty"`   // Validation rule, e.g. "min".
+	Param   string `json:"param,omitempty"`  // Validation rule parameter.
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	if e.Source != "" {
+		return fmt.Sprintf("%s (%s): %s", e.Field, e.Source, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// BindError is returned by Bind and lists every field that failed.
+type BindError struct {
+	Fields []FieldError
+}
+
+func (e *BindError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Error()
+	}
+	return "invalid request parameters: " + strings.Join(msgs, "; ")
+}
+
+// Bind fills the struct pointed to by dst from the request, driven by struct
+// tags:
+//
+//	type Params struct {
+//		ID     int       `path:"id"`
+//		Page   int       `query:"page" default:"1"`
+//		Tags   []string  `query:"tag"`
+//		Email  string    `form:"email"`
+//		Tenant string    `header:"X-Tenant"`
+//		SID    *string   `cookie:"sid"`
+//		Since  time.Time `query:"since"`
+//	}
+//
+// A field may carry several source tags; the first source with a value wins,
+// and the default tag applies when none has one. Supported types are strings,
+// bools, integers, floats, time.Duration, time.Time (RFC 3339 or 2006-01-02),
+// encoding.TextUnmarshaler, and pointers and slices of those. Untagged
+// struct fields are bound recursively. If any field fails, Bind returns a
+// *BindError listing all of them.
+func Bind(r *http.Request, dst any) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Bind requires a non-nil pointer to a struct, got %T", dst)
+	}
+	if usesFormTag(v.Elem().Type()) {
+		if err := parseForm(r); err != nil {
+			return &BindError{Fields: []FieldError{{Field: "body", Source: "form", Message: err.Error()}}}
+		}
+	}
+
+	var fieldErrors []FieldError
+	bindStruct(r, v.Elem(), &fieldErrors)
+	if len(fieldErrors) > 0 {
+		return &BindError{Fields: fieldErrors}
+	}
+	return nil
+}
+
+func bindStruct(r *http.Request, v reflect.Value, fieldErrors *[]FieldError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		field := v.Field(i)
+
+		source, key, values := lookupBindValues(r, sf)
+		if source == "" {
+			if isNestedStruct(sf.Type) {
+				bindStruct(r, field, fieldErrors)
+			}
+			continue
+		}
+		if len(values) == 0 {
+			def, ok := sf.Tag.Lookup("default")
+			if !ok {
+				continue
+			}
+			values = []string{def}
+		}
+		if err := setField(field, values); err != nil {
+			*fieldErrors = append(*fieldErrors, FieldError{
+				Field:   key,
+				Source:  source,
+				Value:   strings.Join(values, ","),
+				Message: err.Error(),
+			})
+		}
+	}
+}
+
+// lookupBindValues returns the first tagged source with a value for the
+// field. If none has a value, it returns the first tagged source and no values.
+func lookupBindValues(r *http.Request, sf reflect.StructField) (source, key string, values []string) {
+	for _, src := range bindSources {
+		name, ok := sf.Tag.Lookup(src)
+		if !ok || name == "" || name == "-" {
+			continue
+		}
+		if source == "" {
+			source, key = src, name
+		}
+		var found []string
+		switch src {
+		case "path":
+			if val := r.PathValue(name); val != "" {
+				found = []string{val}
+			}
+		case "query":
+			found = r.URL.Query()[name]
+		case "form":
+			found = r.Form[name]
+		case "header":
+			found = r.Header.Values(name)
+		case "cookie":
+			if c, err := r.Cookie(name); err == nil {
+				found = []string{c.Value}
+			}
+		}
+		if len(found) > 0 {
+			return src, name, found
+		}
+	}
+	return source, key, nil
+}
+
+var (
+	timeType            = reflect.TypeFor[time.Time]()
+	durationType        = reflect.TypeFor[time.Duration]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// setField converts values into field, allocating pointers and slices.
+func setField(field reflect.Value, values []string) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, val := range values {
+			if err := setScalar(slice.Index(i), val); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	return setScalar(field, values[0])
+}
+
+func setScalar(field reflect.Value, val string) error {
+	if field.Kind() == reflect.Pointer {
+		ptr := reflect.New(field.Type().Elem())
+		if err := setScalar(ptr.Elem(), val); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+
+	switch field.Type() {
+	case timeType:
+		for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+			if tm, err := time.Parse(layout, val); err == nil {
+				field.Set(reflect.ValueOf(tm))
+				return nil
+			}
+		}
+		return errors.New("must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	case durationType:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return errors.New("must be a duration such as 1m30s")
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	if reflect.PointerTo(field.Type()).Implements(textUnmarshalerType) {
+		return field.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(val))
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a non-negative integer")
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		// []byte
+		field.SetBytes([]byte(val))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// isNestedStruct reports whether Bind should recurse into an untagged field.
+func isNestedStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType && !reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+func usesFormTag(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if _, ok := sf.Tag.Lookup("form"); ok {
+			return true
+		}
+		if sf.IsExported() && isNestedStruct(sf.Type) && usesFormTag(sf.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForm parses URL-encoded and multipart bodies into r.Form.
+func parseForm(r *http.Request) error {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		err := r.ParseMultipartForm(32 << 20)
+		if errors.Is(err, http.ErrNotMultipart) {
+			return r.ParseForm()
+		}
+		return err
+	}
+	return r.ParseForm()
+}
@@ -0,0 +1,189 @@
+package vii
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig holds the configuration for CORSWithConfig.
+type CORSConfig struct {
+	// AllowOrigins lists the origins allowed to make cross-origin requests.
+	// Entries are exact origins ("https://example.com"), wildcard subdomains
+	// ("https://*.example.com") or "*" for any origin.
+	AllowOrigins []string
+	// AllowOriginFunc, if set, is consulted for origins not matched by
+	// AllowOrigins.
+	AllowOriginFunc func(origin string) bool
+	// AllowMethods defaults to GET, HEAD, POST, PUT, PATCH and DELETE.
+	AllowMethods []string
+	// AllowHeaders defaults to Content-Type and Authorization. CORS-safelisted
+	// request headers are always allowed.
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	MaxAge           time.Duration // How long browsers may cache a preflight result.
+	AllowCredentials bool          // Cannot be combined with AllowOrigins "*".
+}
+
+// CORSWithConfig returns a middleware that applies the CORS policy in config.
+// Requests from origins outside the policy get no CORS headers, and failed
+// preflight requests are answered with 403 so the browser blocks the call.
+func CORSWithConfig(config CORSConfig) func(http.Handler) http.Handler {
+	if len(config.AllowMethods) == 0 {
+		config.AllowMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	if len(config.AllowHeaders) == 0 {
+		config.AllowHeaders = []string{"Content-Type", "Authorization"}
+	}
+
+	origins := parseOriginList(config.AllowOrigins)
+	if origins.any && config.AllowCredentials {
+		panic(`vii: CORSConfig.AllowCredentials cannot be used with AllowOrigins "*"`)
+	}
+
+	allowedMethods := make(map[string]bool)
+	for _, method := range config.AllowMethods {
+		allowedMethods[strings.ToUpper(method)] = true
+	}
+	allowedHeaders := map[string]bool{
+		"accept":           true,
+		"accept-language":  true,
+		"content-language": true,
+	}
+	for _, header := range config.AllowHeaders {
+		allowedHeaders[strings.ToLower(header)] = true
+	}
+
+	methods := strings.Join(config.AllowMethods, ", ")
+	headers := strings.Join(config.AllowHeaders, ", ")
+	expose := strings.Join(config.ExposeHeaders, ", ")
+	maxAge := ""
+	if config.MaxAge > 0 {
+		maxAge = strconv.Itoa(int(config.MaxAge.Seconds()))
+	}
+
+	originAllowed := func(origin string) bool {
+		return origins.match(origin) || (config.AllowOriginFunc != nil && config.AllowOriginFunc(origin))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if preflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+			}
+
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !originAllowed(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if preflight {
+				if !allowedMethods[strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))] {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+					header = strings.ToLower(strings.TrimSpace(header))
+					if header != "" && !allowedHeaders[header] {
+						w.WriteHeader(http.StatusForbidden)
+						return
+					}
+				}
+			}
+
+			if origins.any {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if config.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				if expose != "" {
+					h.Set("Access-Control-Expose-Headers", expose)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h.Set("Access-Control-Allow-Methods", methods)
+			h.Set("Access-Control-Allow-Headers", headers)
+			if maxAge != "" {
+				h.Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// originList matches origins against exact entries, wildcard subdomains
+// such as "https://*.example.com", and "*".
+type originList struct {
+	any       bool
+	exact     []string
+	wildcards [][2]string
+}
+
+func parseOriginList(origins []string) originList {
+	var list originList
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimRight(origin, "/"))
+		switch {
+		case origin == "*":
+			list.any = true
+		case strings.Contains(origin, "*"):
+			prefix, suffix, _ := strings.Cut(origin, "*")
+			list.wildcards = append(list.wildcards, [2]string{prefix, suffix})
+		default:
+			list.exact = append(list.exact, origin)
+		}
+	}
+	return list
+}
+
+func (list originList) match(origin string) bool {
+	if list.any {
+		return true
+	}
+	lower := strings.ToLower(origin)
+	for _, o := range list.exact {
+		if lower == o {
+			return true
+		}
+	}
+	for _, w := range list.wildcards {
+		if matchWildcardOrigin(lower, w[0], w[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWildcardOrigin reports whether origin matches prefix*suffix, where the
+// wildcard stands for one or more subdomain labels.
+func matchWildcardOrigin(origin, prefix, suffix string) bool {
+	if len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	middle := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(middle, "/:@") && !strings.HasPrefix(middle, ".") && !strings.HasSuffix(middle, ".")
+}
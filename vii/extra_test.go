@@ -1,11 +1,31 @@
 package vii
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"testing/fstest"
+	"time"
 )
 
 func TestMiddlewareOrder(t *testing.T) {
@@ -310,3 +330,1702 @@ func TestFSOperations(t *testing.T) {
 		}
 	})
 }
+
+func TestRoutes(t *testing.T) {
+	app := NewApp()
+	app.Use(Logger)
+	app.Handle("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {}).Named("user")
+	api := app.Group("/api")
+	api.Use(CORS)
+	api.Handle("POST /items", func(w http.ResponseWriter, r *http.Request) {}, Timeout(5))
+	app.Favicon()
+	app.ServeDir("/static", "static")
+	app.ServeFS("/assets", fstest.MapFS{})
+
+	routes := app.Routes()
+	if len(routes) != 5 {
+		t.Fatalf("Expected 5 routes, got %d", len(routes))
+	}
+
+	user := routes[0]
+	if user.Method != "GET" || user.Path != "/users/{id}" || user.Name != "user" {
+		t.Errorf("Unexpected route: %+v", user)
+	}
+	if !strings.HasSuffix(strings.Split(user.Source, ":")[0], "extra_test.go") {
+		t.Errorf("Expected source in extra_test.go, got '%s'", user.Source)
+	}
+
+	item := routes[1]
+	if item.Path != "/api/items" || item.Prefix != "/api" {
+		t.Errorf("Unexpected group route: %+v", item)
+	}
+	expected := []string{"vii.Logger", "vii.CORS", "vii.Timeout"}
+	if strings.Join(item.Middleware, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected middleware %v, got %v", expected, item.Middleware)
+	}
+
+	paths := []string{routes[2].Path, routes[3].Path, routes[4].Path}
+	if strings.Join(paths, ",") != "/favicon.ico,/static/,/assets/" {
+		t.Errorf("Unexpected static routes: %v", paths)
+	}
+
+	var table strings.Builder
+	if err := WriteRoutes(&table, routes); err != nil {
+		t.Fatalf("WriteRoutes failed: %v", err)
+	}
+	if !strings.Contains(table.String(), "/api/items") {
+		t.Errorf("Expected table to list /api/items, got:\n%s", table.String())
+	}
+
+	var out strings.Builder
+	if err := WriteRoutesJSON(&out, routes); err != nil {
+		t.Fatalf("WriteRoutesJSON failed: %v", err)
+	}
+	if !strings.Contains(out.String(), `"path": "/users/{id}"`) {
+		t.Errorf("Expected JSON to contain user route, got:\n%s", out.String())
+	}
+}
+
+func TestErrorHandlers(t *testing.T) {
+	app := NewApp()
+	app.HandleErr("GET /missing", func(w http.ResponseWriter, r *http.Request) error {
+		return &HTTPError{Status: http.StatusNotFound, Message: "no such thing"}
+	})
+	app.HandleErr("GET /boom", HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("database password is hunter2")
+	}))
+	api := app.Group("/api")
+	api.HandleErr("GET /teapot", func(w http.ResponseWriter, r *http.Request) error {
+		return NewHTTPError(http.StatusTeapot, "")
+	})
+
+	t.Run("HTTPError", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/missing", nil)
+		req.Header.Set("Accept", "text/plain")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+		if strings.TrimSpace(w.Body.String()) != "no such thing" {
+			t.Errorf("Unexpected body '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("ProblemByDefault", func(t *testing.T) {
+		for _, accept := range []string{"", "*/*", "application/json", "text/html;q=0.5, */*"} {
+			req := httptest.NewRequest("GET", "/missing", nil)
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, req)
+			if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/problem+json" {
+				t.Errorf("Accept %q: expected a 404 problem, got %d %s", accept, w.Code, w.Header().Get("Content-Type"))
+			}
+		}
+		req := httptest.NewRequest("GET", "/missing", nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+			t.Errorf("Expected plain text for a browser, got %s", w.Header().Get("Content-Type"))
+		}
+	})
+
+	t.Run("UnknownErrorHidden", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/boom", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status 500, got %d", w.Code)
+		}
+		if strings.Contains(w.Body.String(), "hunter2") {
+			t.Error("Internal error details leaked to the client")
+		}
+	})
+
+	t.Run("GroupDefaultMessage", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/api/teapot", nil))
+		if w.Code != http.StatusTeapot {
+			t.Errorf("Expected status 418, got %d", w.Code)
+		}
+	})
+
+	t.Run("OnError", func(t *testing.T) {
+		var got error
+		app.OnError(func(w http.ResponseWriter, r *http.Request, err error) {
+			got = err
+			WriteError(w, http.StatusBadGateway, "custom")
+		})
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/boom", nil))
+		if w.Code != http.StatusBadGateway || got == nil {
+			t.Errorf("Expected custom error handler to run, got status %d", w.Code)
+		}
+	})
+}
+
+func TestServerLifecycle(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, name)
+	}
+
+	app := NewApp()
+	app.Handle("GET /slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	started := make(chan struct{})
+	app.OnStart(func() error { record("start1"); return nil })
+	app.OnStart(func() error { record("start2"); close(started); return nil })
+	app.OnShutdown(func(ctx context.Context) error { record("shutdown1"); return nil })
+	app.OnShutdown(func(ctx context.Context) error { record("shutdown2"); return nil })
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- app.ServeWithConfig(ServerConfig{Addr: addr, WriteTimeout: time.Second})
+	}()
+	<-started
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := <-serveErr; err != nil {
+		t.Errorf("Expected ServeWithConfig to return nil after Shutdown, got %v", err)
+	}
+	if got := <-body; got != "done" {
+		t.Errorf("Expected in-flight request to finish with 'done', got '%s'", got)
+	}
+
+	expected := "start1,start2,shutdown1,shutdown2"
+	if strings.Join(order, ",") != expected {
+		t.Errorf("Expected hook order %s, got %v", expected, order)
+	}
+}
+
+func TestServerShutdownBeforeServing(t *testing.T) {
+	t.Run("DuringStartHooks", func(t *testing.T) {
+		app := NewApp()
+		app.OnStart(func() error {
+			return app.Shutdown(context.Background())
+		})
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- app.ServeWithConfig(ServerConfig{Addr: "127.0.0.1:0"})
+		}()
+		select {
+		case err := <-serveErr:
+			if err != nil {
+				t.Errorf("Expected nil after Shutdown, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("ServeWithConfig kept serving after Shutdown")
+		}
+	})
+
+	t.Run("BeforeServe", func(t *testing.T) {
+		app := NewApp()
+		app.Shutdown(context.Background())
+		if err := app.ServeWithConfig(ServerConfig{Addr: "127.0.0.1:0"}); err != nil {
+			t.Errorf("Expected nil after Shutdown, got %v", err)
+		}
+	})
+
+	t.Run("HalfConfiguredTLS", func(t *testing.T) {
+		app := NewApp()
+		if err := app.ServeWithConfig(ServerConfig{Addr: "127.0.0.1:0", TLSCertFile: "cert.pem"}); err == nil {
+			t.Error("Expected an error when only TLSCertFile is set")
+		}
+	})
+}
+
+func TestBind(t *testing.T) {
+	type Pagination struct {
+		Page int `query:"page" default:"1"`
+	}
+	type Params struct {
+		ID      int64         `path:"id"`
+		Tags    []string      `query:"tag"`
+		Email   string        `form:"email"`
+		Tenant  string        `header:"X-Tenant"`
+		SID     *string       `cookie:"sid"`
+		Since   time.Time     `query:"since"`
+		Timeout time.Duration `query:"timeout" default:"30s"`
+		Addr    netip.Addr    `header:"X-Addr"`
+		Active  bool          `query:"active" form:"active"`
+		Pagination
+	}
+
+	app := NewApp()
+	var (
+		got     Params
+		bindErr error
+	)
+	app.Handle("POST /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		got = Params{}
+		bindErr = Bind(r, &got)
+	})
+
+	t.Run("AllSources", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/users/42?tag=a&tag=b&since=2024-05-01", strings.NewReader("email=x%40y.com&active=true"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("X-Addr", "::1")
+		req.AddCookie(&http.Cookie{Name: "sid", Value: "s3"})
+		app.ServeHTTP(httptest.NewRecorder(), req)
+
+		if bindErr != nil {
+			t.Fatalf("Bind failed: %v", bindErr)
+		}
+		if got.ID != 42 || strings.Join(got.Tags, ",") != "a,b" || got.Email != "x@y.com" || got.Tenant != "acme" {
+			t.Errorf("Unexpected result %+v", got)
+		}
+		if got.SID == nil || *got.SID != "s3" {
+			t.Errorf("Expected cookie pointer to be set, got %v", got.SID)
+		}
+		if got.Since.Format(time.DateOnly) != "2024-05-01" || got.Timeout != 30*time.Second {
+			t.Errorf("Unexpected time values %v %v", got.Since, got.Timeout)
+		}
+		if got.Addr.String() != "::1" || !got.Active || got.Page != 1 {
+			t.Errorf("Unexpected values %+v", got)
+		}
+	})
+
+	t.Run("AllFailuresReported", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/users/abc?page=x&since=yesterday", nil)
+		app.ServeHTTP(httptest.NewRecorder(), req)
+
+		var bindError *BindError
+		if !errors.As(bindErr, &bindError) {
+			t.Fatalf("Expected *BindError, got %v", bindErr)
+		}
+		var fields []string
+		for _, f := range bindError.Fields {
+			fields = append(fields, f.Source+":"+f.Field)
+		}
+		if strings.Join(fields, ",") != "path:id,query:since,query:page" {
+			t.Errorf("Unexpected failed fields %v", fields)
+		}
+	})
+
+	t.Run("NonPointer", func(t *testing.T) {
+		if err := Bind(httptest.NewRequest("GET", "/", nil), Params{}); err == nil {
+			t.Error("Expected error for non-pointer destination")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	type Item struct {
+		SKU string `json:"sku" validate:"required,len=4"`
+		Qty int    `json:"qty" validate:"min=1,max=99"`
+	}
+	type Order struct {
+		Name    string  `json:"name" validate:"required,min=3,max=8"`
+		Email   string  `json:"email" validate:"email"`
+		Plan    string  `json:"plan" validate:"oneof=free pro"`
+		Website string  `json:"website" validate:"url"`
+		Coupon  *string `json:"coupon" validate:"even"`
+		Count   *int    `json:"count" validate:"required"`
+		Items   []Item  `json:"items" validate:"required,max=2"`
+	}
+
+	RegisterValidation("even", func(v reflect.Value, param string) error {
+		if len(v.String())%2 != 0 {
+			return errors.New("must have an even length")
+		}
+		return nil
+	})
+	t.Cleanup(func() {
+		validationMu.Lock()
+		delete(validationRules, "even")
+		validationMu.Unlock()
+		validationCache.Clear()
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		zero := 0
+		order := Order{Name: "ada", Plan: "pro", Count: &zero, Items: []Item{{SKU: "ABCD", Qty: 2}}}
+		if err := Validate(&order); err != nil {
+			t.Errorf("Expected no errors, got %v", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		coupon := "odd"
+		order := Order{
+			Name:    "al",
+			Email:   "not-an-email",
+			Plan:    "gold",
+			Website: "/relative",
+			Coupon:  &coupon,
+			Items:   []Item{{SKU: "ABCD", Qty: 1}, {SKU: "X", Qty: 0}},
+		}
+		err := Validate(order)
+		var errs ValidationErrors
+		if !errors.As(err, &errs) {
+			t.Fatalf("Expected ValidationErrors, got %v", err)
+		}
+		var got []string
+		for _, f := range errs {
+			got = append(got, f.Field+":"+f.Rule)
+		}
+		expected := "name:min,email:email,plan:oneof,website:url,coupon:even,count:required,items[1].sku:len,items[1].qty:min"
+		if strings.Join(got, ",") != expected {
+			t.Errorf("Expected %s, got %s", expected, strings.Join(got, ","))
+		}
+		if errs.Map()["name"] != "must have at least 3 characters" {
+			t.Errorf("Unexpected message '%s'", errs.Map()["name"])
+		}
+	})
+
+	t.Run("ReadAndValidateJSON", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"ok"}`))
+		var order Order
+		err := ReadAndValidateJSON(req, httptest.NewRecorder(), &order)
+		var errs ValidationErrors
+		if !errors.As(err, &errs) {
+			t.Fatalf("Expected ValidationErrors, got %v", err)
+		}
+	})
+
+	t.Run("InvalidTags", func(t *testing.T) {
+		type Unknown struct {
+			Name string `validate:"required,bogus"`
+		}
+		type BadParam struct {
+			Nested struct {
+				Age int `validate:"min=abc"`
+			}
+		}
+		for _, v := range []any{Unknown{}, &BadParam{}} {
+			err := Validate(v)
+			var errs ValidationErrors
+			if err == nil || errors.As(err, &errs) {
+				t.Errorf("Expected a tag error for %T, got %v", v, err)
+			}
+		}
+
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected JSONHandler to panic on invalid tags")
+			}
+		}()
+		JSONHandler(func(ctx context.Context, req Unknown) (struct{}, error) { return struct{}{}, nil })
+	})
+
+	t.Run("DefaultErrorHandler", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		DefaultErrorHandler(w, httptest.NewRequest("GET", "/", nil), Validate(Order{}))
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422, got %d", w.Code)
+		}
+	})
+}
+
+func TestProblem(t *testing.T) {
+	t.Run("WriteProblem", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		p := NewProblem(http.StatusForbidden, "no access")
+		p.Type = "https://example.com/probs/forbidden"
+		p.Extensions = map[string]any{"balance": 30, "status": "ignored"}
+		if err := WriteProblem(w, p); err != nil {
+			t.Fatalf("WriteProblem failed: %v", err)
+		}
+		if w.Code != http.StatusForbidden || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("Unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		var body map[string]any
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if body["status"] != float64(403) || body["balance"] != float64(30) || body["title"] != "Forbidden" {
+			t.Errorf("Unexpected body %v", body)
+		}
+	})
+
+	t.Run("ErrorHandlerNegotiates", func(t *testing.T) {
+		app := NewApp()
+		app.HandleErr("POST /orders", func(w http.ResponseWriter, r *http.Request) error {
+			var order struct {
+				Name string `json:"name" validate:"required"`
+			}
+			return ReadAndValidateJSON(r, w, &order)
+		})
+
+		req := httptest.NewRequest("POST", "/orders", strings.NewReader(`{"name":""}`))
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnprocessableEntity || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Fatalf("Unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+		var body struct {
+			Errors []FieldError `json:"errors"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if len(body.Errors) != 1 || body.Errors[0].Field != "name" || body.Errors[0].Rule != "required" {
+			t.Errorf("Unexpected errors %+v", body.Errors)
+		}
+	})
+
+	t.Run("ZeroStatus", func(t *testing.T) {
+		for _, accept := range []string{"", "text/plain"} {
+			for _, err := range []error{&Problem{Detail: "no status"}, &HTTPError{Message: "no status"}} {
+				req := httptest.NewRequest("GET", "/", nil)
+				if accept != "" {
+					req.Header.Set("Accept", accept)
+				}
+				w := httptest.NewRecorder()
+				DefaultErrorHandler(w, req, err)
+				if w.Code != http.StatusInternalServerError {
+					t.Errorf("Expected status 500 for %T with Accept %q, got %d", err, accept, w.Code)
+				}
+			}
+		}
+		if p := ProblemFrom(&HTTPError{}); p.Status != http.StatusInternalServerError || p.Title != "Internal Server Error" {
+			t.Errorf("Unexpected problem %+v", p)
+		}
+	})
+
+	t.Run("Middleware", func(t *testing.T) {
+		limited := RateLimiter(RateLimiterConfig{Limit: 1, ErrorResponder: ProblemError})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		limited.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		w := httptest.NewRecorder()
+		limited.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Content-Type") != "application/problem+json" {
+			t.Errorf("Unexpected rate limit response %d %s", w.Code, w.Header().Get("Content-Type"))
+		}
+
+		slow := TimeoutWithConfig(TimeoutConfig{Duration: 10 * time.Millisecond, ErrorResponder: ProblemError})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		w = httptest.NewRecorder()
+		slow.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"instance":"/slow"`) {
+			t.Errorf("Unexpected timeout response %d %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestJSONHandler(t *testing.T) {
+	type CreateUser struct {
+		OrgID int    `json:"-" path:"org"`
+		Name  string `json:"name" validate:"required"`
+	}
+	type User struct {
+		ID    int    `json:"id"`
+		OrgID int    `json:"org_id"`
+		Name  string `json:"name"`
+	}
+
+	app := NewApp()
+	create := JSONHandler(func(ctx context.Context, req CreateUser) (User, error) {
+		if req.Name == "taken" {
+			return User{}, NewHTTPError(http.StatusConflict, "name is taken")
+		}
+		return User{ID: 1, OrgID: req.OrgID, Name: req.Name}, nil
+	})
+	app.Group("/orgs/{org}").HandleTyped("POST /users", create)
+
+	if create.Request != reflect.TypeFor[CreateUser]() || create.Response != reflect.TypeFor[User]() {
+		t.Errorf("Unexpected handler types %v %v", create.Request, create.Response)
+	}
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/orgs/7/users", strings.NewReader(body))
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		w := serve(`{"name":"ada"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if strings.TrimSpace(w.Body.String()) != `{"id":1,"org_id":7,"name":"ada"}` {
+			t.Errorf("Unexpected body %s", w.Body.String())
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		cases := map[string]int{
+			`{"name":""}`:      http.StatusUnprocessableEntity,
+			`{"name":`:         http.StatusBadRequest,
+			`{"name":"taken"}`: http.StatusConflict,
+		}
+		for body, status := range cases {
+			if w := serve(body); w.Code != status {
+				t.Errorf("Expected status %d for %s, got %d", status, body, w.Code)
+			}
+		}
+	})
+
+	t.Run("BoundOnly", func(t *testing.T) {
+		type Params struct {
+			ID     int    `path:"id"`
+			Force  bool   `query:"force"`
+			Tenant string `header:"X-Tenant" validate:"required"`
+			Note   string `json:"-"`
+		}
+		handler := JSONHandler(func(ctx context.Context, req Params) (Params, error) {
+			return req, nil
+		})
+		app.HandleTyped("POST /items/{id}/archive", handler)
+
+		req := httptest.NewRequest("POST", "/items/3/archive?force=true", nil)
+		req.Header.Set("X-Tenant", "acme")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 without a body, got %d: %s", w.Code, w.Body.String())
+		}
+		if strings.TrimSpace(w.Body.String()) != `{"ID":3,"Force":true,"Tenant":"acme"}` {
+			t.Errorf("Unexpected body %s", w.Body.String())
+		}
+	})
+
+	t.Run("PointerRequest", func(t *testing.T) {
+		type Rename struct {
+			ID   int    `json:"-" path:"id"`
+			Name string `json:"name" validate:"required,min=3"`
+		}
+		app := NewApp()
+		app.HandleTyped("PUT /items/{id}", JSONHandler(func(ctx context.Context, req *Rename) (*Rename, error) {
+			return req, nil
+		}))
+
+		serve := func(body string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, httptest.NewRequest("PUT", "/items/9", strings.NewReader(body)))
+			return w
+		}
+		if w := serve(`{"name":"desk"}`); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"name":"desk"}` {
+			t.Errorf("Unexpected response %d %s", w.Code, w.Body.String())
+		}
+		if w := serve(`{"name":""}`); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected validation to fail with 422, got %d", w.Code)
+		}
+
+		type Lookup struct {
+			ID int `path:"id"`
+		}
+		var bound int
+		app.HandleTyped("GET /bound/{id}", JSONHandler(func(ctx context.Context, req *Lookup) (struct{}, error) {
+			bound = req.ID
+			return struct{}{}, nil
+		}))
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/bound/9", nil))
+		if bound != 9 {
+			t.Errorf("Expected the path to be bound, got ID %d", bound)
+		}
+
+		op := app.OpenAPI(OpenAPIConfig{}).Paths["/items/{id}"]["put"]
+		if op == nil || len(op.Parameters) != 1 || op.Parameters[0].Schema.Type != "integer" || op.RequestBody == nil {
+			t.Errorf("Unexpected operation %+v", op)
+		}
+	})
+}
+
+func TestOpenAPI(t *testing.T) {
+	type Address struct {
+		City string `json:"city" validate:"required"`
+	}
+	type CreateUser struct {
+		OrgID   int      `json:"-" path:"org"`
+		DryRun  bool     `json:"-" query:"dry_run"`
+		Name    string   `json:"name" validate:"required,min=3,max=64"`
+		Plan    string   `json:"plan,omitempty" validate:"oneof=free pro"`
+		Email   *string  `json:"email,omitempty" validate:"email"`
+		Address Address  `json:"address"`
+		Tags    []string `json:"tags" validate:"max=5"`
+	}
+	type User struct {
+		ID      int       `json:"id"`
+		Name    string    `json:"name"`
+		Address *Address  `json:"address,omitempty"`
+		Created time.Time `json:"created"`
+	}
+
+	app := NewApp()
+	app.ServeDir("/static", ".")
+	app.ServeOpenAPI("/openapi.json", OpenAPIConfig{Title: "Users"})
+	app.ServeOpenAPI("/openapi.yaml", OpenAPIConfig{Title: "Users"})
+	api := app.Group("/orgs/{org}")
+	api.HandleTyped("POST /users", JSONHandler(func(ctx context.Context, req CreateUser) (User, error) {
+		return User{}, nil
+	})).Named("createUser")
+	search := NewURL("/files/{path...}").WithQuery("q")
+	app.Handle(search.Pattern("GET"), func(w http.ResponseWriter, r *http.Request) {}).WithURL(search)
+
+	req := httptest.NewRequest("GET", "/openapi.json", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	var doc OpenAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Failed to decode document: %v", err)
+	}
+
+	if doc.OpenAPI != "3.1.0" || doc.Info.Title != "Users" || doc.Info.Version != "1.0.0" {
+		t.Errorf("Unexpected document header %+v", doc.Info)
+	}
+	if len(doc.Paths) != 2 {
+		t.Errorf("Expected 2 documented paths, got %v", doc.Paths)
+	}
+
+	t.Run("TypedRoute", func(t *testing.T) {
+		op := doc.Paths["/orgs/{org}/users"]["post"]
+		if op == nil {
+			t.Fatalf("Missing operation, got %v", doc.Paths)
+		}
+		if op.OperationID != "createUser" {
+			t.Errorf("Expected operationId createUser, got %q", op.OperationID)
+		}
+		if len(op.Parameters) != 2 {
+			t.Fatalf("Expected 2 parameters, got %+v", op.Parameters)
+		}
+		if p := op.Parameters[0]; p.Name != "org" || p.In != "path" || !p.Required || p.Schema.Type != "integer" {
+			t.Errorf("Unexpected path parameter %+v", p)
+		}
+		if p := op.Parameters[1]; p.Name != "dry_run" || p.In != "query" || p.Required || p.Schema.Type != "boolean" {
+			t.Errorf("Unexpected query parameter %+v", p)
+		}
+
+		body := op.RequestBody.Content["application/json"].Schema
+		if _, ok := body.Properties["OrgID"]; ok || len(body.Properties) != 5 {
+			t.Errorf("Expected only JSON fields in the body, got %v", body.Properties)
+		}
+		if !slices.Equal(body.Required, []string{"name"}) {
+			t.Errorf("Expected name to be required, got %v", body.Required)
+		}
+		if name := body.Properties["name"]; *name.MinLength != 3 || *name.MaxLength != 64 {
+			t.Errorf("Unexpected name schema %+v", name)
+		}
+		if plan := body.Properties["plan"]; len(plan.Enum) != 2 {
+			t.Errorf("Unexpected plan schema %+v", plan)
+		}
+		if email := body.Properties["email"]; email.Format != "email" || fmt.Sprint(email.Type) != "[string null]" {
+			t.Errorf("Unexpected email schema %+v", email)
+		}
+		if tags := body.Properties["tags"]; tags.Type != "array" || *tags.MaxItems != 5 {
+			t.Errorf("Unexpected tags schema %+v", tags)
+		}
+		if ref := body.Properties["address"].Ref; ref != "#/components/schemas/Address" {
+			t.Errorf("Expected address to reference a component, got %q", ref)
+		}
+
+		res := op.Responses["200"].Content["application/json"].Schema
+		if res.Ref != "#/components/schemas/User" {
+			t.Errorf("Expected response to reference User, got %+v", res)
+		}
+		if op.Responses["default"].Content["application/problem+json"].Schema.Ref != "#/components/schemas/Problem" {
+			t.Errorf("Expected problem error response, got %+v", op.Responses["default"])
+		}
+		user := doc.Components.Schemas["User"]
+		if user == nil || user.Properties["created"].Format != "date-time" {
+			t.Errorf("Unexpected User component %+v", user)
+		}
+		if _, ok := doc.Components.Schemas["Address"]; !ok {
+			t.Errorf("Expected Address component, got %v", doc.Components.Schemas)
+		}
+	})
+
+	t.Run("PlainRoute", func(t *testing.T) {
+		op := doc.Paths["/files/{path}"]["get"]
+		if op == nil {
+			t.Fatalf("Missing operation, got %v", doc.Paths)
+		}
+		if len(op.Parameters) != 2 || op.Parameters[0].Name != "path" || op.Parameters[1].Name != "q" || op.Parameters[1].In != "query" {
+			t.Errorf("Unexpected parameters %+v", op.Parameters)
+		}
+		if op.RequestBody != nil || op.Responses != nil {
+			t.Errorf("Expected no body or responses for an untyped route")
+		}
+	})
+
+	t.Run("YAML", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/openapi.yaml", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		if w.Header().Get("Content-Type") != "application/yaml" {
+			t.Errorf("Unexpected content type %q", w.Header().Get("Content-Type"))
+		}
+		yaml := w.Body.String()
+		for _, want := range []string{
+			"openapi: \"3.1.0\"\n",
+			"info:\n  title: Users\n",
+			"  \"/orgs/{org}/users\":\n    post:\n      operationId: createUser\n",
+			"      parameters:\n        - name: org\n          in: path\n          required: true\n",
+			"                  enum:\n                    - free\n                    - pro\n",
+			"                $ref: \"#/components/schemas/User\"\n",
+		} {
+			if !strings.Contains(yaml, want) {
+				t.Errorf("Expected YAML to contain %q, got:\n%s", want, yaml)
+			}
+		}
+	})
+}
+
+func TestRespond(t *testing.T) {
+	type Item struct {
+		XMLName xml.Name `json:"-" csv:"-" xml:"item"`
+		SKU     string   `json:"sku" xml:"sku"`
+		Qty     int      `json:"qty" csv:"quantity" xml:"qty"`
+	}
+	items := []Item{{SKU: "a1", Qty: 2}, {SKU: "b2", Qty: 5}}
+
+	RegisterResponder("text/csv", CSVResponder)
+	RegisterResponder("application/x-ndjson", NDJSONResponder)
+	t.Cleanup(func() {
+		respondersMu.Lock()
+		responders = responders[:4]
+		respondersMu.Unlock()
+	})
+
+	app := NewApp()
+	templates := template.Must(template.New("item.html").Parse(`<p>{{.SKU}}</p>`))
+	app.SetContext(VII_CONTEXT, templates)
+	app.HandleErr("GET /items", func(w http.ResponseWriter, r *http.Request) error {
+		return Respond(w, r, http.StatusOK, items)
+	})
+	app.HandleErr("GET /item", func(w http.ResponseWriter, r *http.Request) error {
+		return Respond(w, r, http.StatusCreated, View("item.html", items[0]))
+	})
+
+	tests := []struct {
+		path, accept string
+		status       int
+		contentType  string
+		body         string
+	}{
+		{"/items", "", 200, "application/json", `[{"sku":"a1","qty":2},{"sku":"b2","qty":5}]` + "\n"},
+		{"/items", "*/*", 200, "application/json", `[{"sku":"a1","qty":2},{"sku":"b2","qty":5}]` + "\n"},
+		{"/items", "text/csv", 200, "text/csv; charset=utf-8", "sku,quantity\na1,2\nb2,5\n"},
+		{"/items", "application/x-ndjson", 200, "application/x-ndjson", `{"sku":"a1","qty":2}` + "\n" + `{"sku":"b2","qty":5}` + "\n"},
+		{"/items", "application/json;q=0.5, text/*;q=0.8", 200, "text/plain; charset=utf-8", "[{XMLName:{Space: Local:} SKU:a1 Qty:2} {XMLName:{Space: Local:} SKU:b2 Qty:5}]\n"},
+		{"/items", "text/html, application/json;q=0", 406, "text/plain; charset=utf-8", ""},
+		{"/item", "application/xml", 201, "application/xml", xml.Header + "<item><sku>a1</sku><qty>2</qty></item>"},
+		{"/item", "*/*", 201, "text/html; charset=utf-8", "<p>a1</p>"},
+		{"/item", "text/html;q=0.1, application/json", 201, "application/json", `{"sku":"a1","qty":2}` + "\n"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s %q: expected status %d, got %d", tt.path, tt.accept, tt.status, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s %q: expected Content-Type %q, got %q", tt.path, tt.accept, tt.contentType, got)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %q: unexpected body %q", tt.path, tt.accept, w.Body.String())
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s %q: expected Vary: Accept, got %q", tt.path, tt.accept, w.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestSSE(t *testing.T) {
+	t.Run("EventFormat", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/events", nil)
+		w := httptest.NewRecorder()
+		stream, err := SSEWithConfig(w, req, SSEConfig{Retry: 3 * time.Second, Heartbeat: -1})
+		if err != nil {
+			t.Fatalf("SSE failed: %v", err)
+		}
+		stream.Send(Event{ID: "7", Event: "note", Data: "line one\nline two"})
+		stream.Send(Event{Data: map[string]int{"n": 1}})
+		stream.Comment("hi")
+		stream.Close()
+		if err := stream.Send(Event{Data: "late"}); !errors.Is(err, ErrStreamClosed) {
+			t.Errorf("Expected ErrStreamClosed after Close, got %v", err)
+		}
+
+		if w.Header().Get("Content-Type") != "text/event-stream" || w.Header().Get("Cache-Control") != "no-cache" {
+			t.Errorf("Unexpected headers %v", w.Header())
+		}
+		expected := "retry: 3000\n\n" +
+			"id: 7\nevent: note\ndata: line one\ndata: line two\n\n" +
+			"data: {\"n\":1}\n\n" +
+			": hi\n\n"
+		if w.Body.String() != expected {
+			t.Errorf("Unexpected stream:\n%q\nexpected:\n%q", w.Body.String(), expected)
+		}
+	})
+
+	t.Run("NoFlusher", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		w := struct{ http.ResponseWriter }{rec} // hides the recorder's Flush
+		_, err := SSE(w, httptest.NewRequest("GET", "/events", nil))
+		if !errors.Is(err, http.ErrNotSupported) {
+			t.Fatalf("Expected ErrNotSupported, got %v", err)
+		}
+		http.Error(w, "no streaming", http.StatusInternalServerError)
+		if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") == "text/event-stream" {
+			t.Errorf("Expected the error response to be writable, got %d %v", rec.Code, rec.Header())
+		}
+
+		rec = httptest.NewRecorder()
+		handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := SSE(w, r); !errors.Is(err, http.ErrNotSupported) {
+				t.Errorf("Expected ErrNotSupported behind Recover, got %v", err)
+			}
+			if err := http.NewResponseController(w).Flush(); !errors.Is(err, http.ErrNotSupported) {
+				t.Errorf("Expected Flush to report ErrNotSupported, got %v", err)
+			}
+			http.Error(w, "no streaming", http.StatusInternalServerError)
+		}))
+		handler.ServeHTTP(struct{ http.ResponseWriter }{rec}, httptest.NewRequest("GET", "/events", nil))
+		if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") == "text/event-stream" {
+			t.Errorf("Expected the error response behind Recover, got %d %v", rec.Code, rec.Header())
+		}
+	})
+
+	t.Run("BrokerThroughTimeout", func(t *testing.T) {
+		broker := NewBroker(BrokerConfig{})
+		app := NewApp()
+		app.HandleErr("GET /events", func(w http.ResponseWriter, r *http.Request) error {
+			return broker.ServeSSE(w, r, "news")
+		}, TimeoutWithConfig(TimeoutConfig{Duration: 50 * time.Millisecond}))
+		server := httptest.NewServer(app)
+		defer server.Close()
+
+		connect := func(lastEventID string) (*http.Response, *bufio.Reader) {
+			req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+			if lastEventID != "" {
+				req.Header.Set("Last-Event-ID", lastEventID)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+				t.Fatalf("Unexpected response %d %q", res.StatusCode, res.Header.Get("Content-Type"))
+			}
+			return res, bufio.NewReader(res.Body)
+		}
+		readEvent := func(br *bufio.Reader) string {
+			var lines []string
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+				if line == "\n" {
+					return strings.Join(lines, "|")
+				}
+				lines = append(lines, strings.TrimSuffix(line, "\n"))
+			}
+		}
+		waitForSubscribers := func(n int) {
+			for i := 0; i < 100; i++ {
+				broker.mu.Lock()
+				count := len(broker.subscribers["news"])
+				broker.mu.Unlock()
+				if count == n {
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			t.Fatalf("Expected %d subscribers", n)
+		}
+
+		res, br := connect("")
+		waitForSubscribers(1)
+		// Publish after the Timeout deadline; the stream must still be open.
+		time.Sleep(100 * time.Millisecond)
+		broker.Publish("news", Event{Data: "first"})
+		broker.Publish("sports", Event{Data: "ignored"})
+		broker.Publish("news", Event{Event: "headline", Data: "second"})
+		if got := readEvent(br); got != "id: 1|data: first" {
+			t.Errorf("Unexpected first event %q", got)
+		}
+		if got := readEvent(br); got != "id: 3|event: headline|data: second" {
+			t.Errorf("Unexpected second event %q", got)
+		}
+		res.Body.Close()
+		waitForSubscribers(0)
+
+		broker.Publish("news", Event{Data: "missed"})
+		res, br = connect("1")
+		defer res.Body.Close()
+		if got := readEvent(br); got != "id: 3|event: headline|data: second" {
+			t.Errorf("Expected resume after event 1, got %q", got)
+		}
+		if got := readEvent(br); got != "id: 4|data: missed" {
+			t.Errorf("Expected missed event on resume, got %q", got)
+		}
+	})
+
+	t.Run("SlowSubscriber", func(t *testing.T) {
+		broker := NewBroker(BrokerConfig{BufferSize: 1})
+		sub := broker.Subscribe("", "a")
+		if n := broker.Publish("a", Event{Data: 1}); n != 1 {
+			t.Errorf("Expected 1 delivery, got %d", n)
+		}
+		if n := broker.Publish("a", Event{Data: 2}); n != 0 {
+			t.Errorf("Expected the full subscriber to be dropped, got %d deliveries", n)
+		}
+		if e := <-sub.Events(); e.Data != 1 {
+			t.Errorf("Unexpected event %+v", e)
+		}
+		if _, ok := <-sub.Events(); ok {
+			t.Error("Expected the events channel to be closed")
+		}
+		sub.Close()
+	})
+}
+
+// wsClient is a minimal WebSocket client for tests.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, serverURL, path string, header http.Header) (*wsClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	req, _ := http.NewRequest("GET", serverURL+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Handshake write failed: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("Handshake read failed: %v", err)
+	}
+	c := &wsClient{t: t, conn: conn, br: br}
+	t.Cleanup(func() { conn.Close() })
+	return c, res
+}
+
+func (c *wsClient) send(fin bool, opcode byte, payload []byte) {
+	c.t.Helper()
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126, byte(n>>8), byte(n))
+	}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatalf("Frame write failed: %v", err)
+	}
+}
+
+func (c *wsClient) read() (opcode byte, payload []byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.br, header); err != nil {
+		c.t.Fatalf("Frame read failed: %v", err)
+	}
+	if header[1]&0x80 != 0 {
+		c.t.Fatal("Server frames must not be masked")
+	}
+	n := int(header[1] & 0x7f)
+	if n == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(c.br, ext)
+		n = int(ext[0])<<8 | int(ext[1])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatalf("Payload read failed: %v", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func (c *wsClient) expectClose(code int) {
+	c.t.Helper()
+	opcode, payload := c.read()
+	if opcode != CloseMessage || len(payload) < 2 || int(payload[0])<<8|int(payload[1]) != code {
+		c.t.Errorf("Expected close %d, got opcode %d payload %v", code, opcode, payload)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	app := NewApp()
+	echo := func(conn *Conn) {
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(typ, msg)
+		}
+	}
+	app.WebSocket("/ws", echo)
+	app.HandleErr("GET /chat", WebSocketWithConfig(WebSocketConfig{
+		AllowOrigins:   []string{"https://*.example.com"},
+		Subprotocols:   []string{"v2", "v1"},
+		MaxMessageSize: 16,
+	}, func(conn *Conn) {
+		conn.WriteMessage(TextMessage, []byte(conn.Subprotocol()))
+		echo(conn)
+	}))
+	private := app.Group("/private")
+	private.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "secret" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	private.WebSocket("/ws", func(conn *Conn) {
+		conn.WriteMessage(TextMessage, []byte("welcome "+conn.Request().Header.Get("Authorization")))
+	})
+	app.WebSocket("/timed", echo, TimeoutWithConfig(TimeoutConfig{Duration: 50 * time.Millisecond}))
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	t.Run("Handshake", func(t *testing.T) {
+		_, res := dialWebSocket(t, server.URL, "/ws", nil)
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected 101, got %d", res.StatusCode)
+		}
+		// The accept key from the RFC 6455 example.
+		if got := res.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Errorf("Unexpected accept key %q", got)
+		}
+	})
+
+	t.Run("EchoAndFragments", func(t *testing.T) {
+		c, _ := dialWebSocket(t, server.URL, "/ws", nil)
+		c.send(true, TextMessage, []byte("hello"))
+		if op, msg := c.read(); op != TextMessage || string(msg) != "hello" {
+			t.Errorf("Unexpected echo %d %q", op, msg)
+		}
+		c.send(false, BinaryMessage, []byte("ab"))
+		c.send(true, PingMessage, []byte("p"))
+		c.send(false, continuationFrame, []byte("cd"))
+		c.send(true, continuationFrame, []byte("ef"))
+		if op, msg := c.read(); op != PongMessage || string(msg) != "p" {
+			t.Errorf("Expected pong between fragments, got %d %q", op, msg)
+		}
+		if op, msg := c.read(); op != BinaryMessage || string(msg) != "abcdef" {
+			t.Errorf("Unexpected reassembled message %d %q", op, msg)
+		}
+		long := strings.Repeat("x", 300)
+		c.send(true, TextMessage, []byte(long))
+		if _, msg := c.read(); string(msg) != long {
+			t.Errorf("Unexpected long echo of %d bytes", len(msg))
+		}
+		c.send(true, CloseMessage, []byte{0x03, 0xe8, 'b', 'y', 'e'})
+		c.expectClose(CloseNormalClosure)
+	})
+
+	t.Run("ProtocolErrors", func(t *testing.T) {
+		c, _ := dialWebSocket(t, server.URL, "/ws", nil)
+		c.send(true, continuationFrame, []byte("x"))
+		c.expectClose(CloseProtocolError)
+
+		c, _ = dialWebSocket(t, server.URL, "/ws", nil)
+		c.send(true, TextMessage, []byte{0xff, 0xfe})
+		c.expectClose(CloseInvalidPayloadData)
+	})
+
+	t.Run("CloseCodes", func(t *testing.T) {
+		cases := map[int]int{
+			1003: 1003,
+			1012: 1012,
+			1013: 1013,
+			1014: 1014,
+			1004: CloseProtocolError,
+			1015: CloseProtocolError,
+			2999: CloseProtocolError,
+			4000: 4000,
+		}
+		for code, expected := range cases {
+			c, _ := dialWebSocket(t, server.URL, "/ws", nil)
+			c.send(true, CloseMessage, []byte{byte(code >> 8), byte(code)})
+			c.expectClose(expected)
+		}
+	})
+
+	t.Run("BehindTimeout", func(t *testing.T) {
+		c, res := dialWebSocket(t, server.URL, "/timed", nil)
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected 101 behind Timeout, got %d", res.StatusCode)
+		}
+		time.Sleep(100 * time.Millisecond)
+		c.send(true, TextMessage, []byte("still here"))
+		if _, msg := c.read(); string(msg) != "still here" {
+			t.Errorf("Unexpected echo after the deadline %q", msg)
+		}
+	})
+
+	t.Run("ConfigAndSizeLimit", func(t *testing.T) {
+		c, res := dialWebSocket(t, server.URL, "/chat", http.Header{
+			"Origin":                 {"https://app.example.com"},
+			"Sec-Websocket-Protocol": {"v1, v2"},
+		})
+		if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Protocol") != "v2" {
+			t.Fatalf("Unexpected handshake %d %v", res.StatusCode, res.Header)
+		}
+		if _, msg := c.read(); string(msg) != "v2" {
+			t.Errorf("Unexpected subprotocol message %q", msg)
+		}
+		c.send(false, TextMessage, []byte("0123456789"))
+		c.send(true, continuationFrame, []byte("0123456789"))
+		c.expectClose(CloseMessageTooBig)
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		cases := []struct {
+			path   string
+			header http.Header
+			status int
+		}{
+			{"/chat", http.Header{"Origin": {"https://evil.com"}}, http.StatusForbidden},
+			{"/ws", http.Header{"Origin": {"https://evil.com"}}, http.StatusForbidden},
+			{"/ws", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusUpgradeRequired},
+			{"/ws", http.Header{"Sec-Websocket-Key": {"short"}}, http.StatusBadRequest},
+			{"/private/ws", nil, http.StatusUnauthorized},
+		}
+		for _, tc := range cases {
+			_, res := dialWebSocket(t, server.URL, tc.path, tc.header)
+			if res.StatusCode != tc.status {
+				t.Errorf("%s %v: expected %d, got %d", tc.path, tc.header, tc.status, res.StatusCode)
+			}
+		}
+		c, res := dialWebSocket(t, server.URL, "/private/ws", http.Header{"Authorization": {"secret"}})
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected authorized upgrade, got %d", res.StatusCode)
+		}
+		if _, msg := c.read(); string(msg) != "welcome secret" {
+			t.Errorf("Unexpected message %q", msg)
+		}
+		c.expectClose(CloseNormalClosure)
+	})
+}
+
+func TestUploads(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+	build := func(files map[string][]byte) (*http.Request, context.CancelFunc) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("title", "holiday")
+		for name, content := range files {
+			fw, _ := mw.CreateFormFile("photo", name)
+			fw.Write(content)
+		}
+		mw.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("POST", "/upload", &body).WithContext(ctx)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return req, cancel
+	}
+
+	t.Run("TempFiles", func(t *testing.T) {
+		dir := t.TempDir()
+		req, cancel := build(map[string][]byte{"../../beach.png": png})
+		result, err := Uploads(req, httptest.NewRecorder(), UploadOptions{Dir: dir, AllowedTypes: []string{"image/*"}})
+		if err != nil {
+			t.Fatalf("Uploads failed: %v", err)
+		}
+		if result.Values.Get("title") != "holiday" || len(result.Files) != 1 {
+			t.Fatalf("Unexpected result %+v", result)
+		}
+		f := result.Files[0]
+		sum := sha256.Sum256(png)
+		if f.Field != "photo" || f.Filename != "beach.png" || f.Size != int64(len(png)) || f.ContentType != "image/png" || f.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("Unexpected file %+v", f)
+		}
+		if filepath.Dir(f.Path) != dir || filepath.Ext(f.Path) != ".png" {
+			t.Errorf("Unexpected temp path %q", f.Path)
+		}
+		if content, _ := os.ReadFile(f.Path); !bytes.Equal(content, png) {
+			t.Error("Temp file content does not match the upload")
+		}
+
+		cancel()
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(f.Path); os.IsNotExist(err) {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Error("Expected the temp file to be removed when the request ended")
+	})
+
+	t.Run("Writer", func(t *testing.T) {
+		var dst bytes.Buffer
+		req, cancel := build(map[string][]byte{"notes.txt": []byte("hello")})
+		defer cancel()
+		result, err := Uploads(req, httptest.NewRecorder(), UploadOptions{Writer: func(file *UploadedFile) (io.Writer, error) {
+			if file.ContentType != "text/plain" {
+				t.Errorf("Expected the sniffed type before writing, got %q", file.ContentType)
+			}
+			return &dst, nil
+		}})
+		if err != nil {
+			t.Fatalf("Uploads failed: %v", err)
+		}
+		if dst.String() != "hello" || result.Files[0].Path != "" || result.Files[0].Size != 5 {
+			t.Errorf("Unexpected writer result %q %+v", dst.String(), result.Files[0])
+		}
+	})
+
+	t.Run("WriterErrors", func(t *testing.T) {
+		diskFull := errors.New("disk full")
+		cases := map[string]struct {
+			writer func(file *UploadedFile) (io.Writer, error)
+			status int
+		}{
+			"Open": {func(file *UploadedFile) (io.Writer, error) { return nil, diskFull }, http.StatusInternalServerError},
+			"Write": {func(file *UploadedFile) (io.Writer, error) {
+				pr, pw := io.Pipe()
+				pr.CloseWithError(diskFull)
+				return pw, nil
+			}, http.StatusInternalServerError},
+			"BodyError": {func(file *UploadedFile) (io.Writer, error) {
+				return nil, &BodyError{Status: http.StatusForbidden, Msg: "uploads are closed"}
+			}, http.StatusForbidden},
+		}
+		for name, tc := range cases {
+			req, cancel := build(map[string][]byte{"notes.txt": []byte("hello")})
+			_, err := Uploads(req, httptest.NewRecorder(), UploadOptions{Writer: tc.writer})
+			cancel()
+			var bodyErr *BodyError
+			if !errors.As(err, &bodyErr) || bodyErr.Status != tc.status {
+				t.Errorf("%s: expected a %d BodyError, got %v", name, tc.status, err)
+				continue
+			}
+			if tc.status == http.StatusInternalServerError && (!errors.Is(err, diskFull) || bodyErr.Field != "photo") {
+				t.Errorf("%s: expected the cause and field to be kept, got %+v", name, bodyErr)
+			}
+		}
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		cases := []struct {
+			name   string
+			files  map[string][]byte
+			opts   UploadOptions
+			status int
+		}{
+			{"SpoofedType", map[string][]byte{"evil.png": []byte("<html><script>alert(1)</script>")}, UploadOptions{AllowedTypes: []string{"image/png"}}, http.StatusUnsupportedMediaType},
+			{"FileSize", map[string][]byte{"a.png": png}, UploadOptions{MaxFileSize: 50}, http.StatusRequestEntityTooLarge},
+			{"TotalSize", map[string][]byte{"a.png": png}, UploadOptions{MaxTotalSize: 100}, http.StatusRequestEntityTooLarge},
+			{"FileCount", map[string][]byte{"a.png": png, "b.png": png}, UploadOptions{MaxFiles: 1}, http.StatusRequestEntityTooLarge},
+		}
+		for _, tc := range cases {
+			dir := t.TempDir()
+			tc.opts.Dir = dir
+			req, cancel := build(tc.files)
+			_, err := Uploads(req, httptest.NewRecorder(), tc.opts)
+			cancel()
+			var bodyErr *BodyError
+			if !errors.As(err, &bodyErr) || bodyErr.Status != tc.status {
+				t.Errorf("%s: expected status %d, got %v", tc.name, tc.status, err)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+				t.Errorf("%s: expected temp files to be removed, found %d", tc.name, len(entries))
+			}
+		}
+
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		var bodyErr *BodyError
+		if _, err := Uploads(req, httptest.NewRecorder(), UploadOptions{}); !errors.As(err, &bodyErr) || bodyErr.Status != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected 415 for a non-multipart body, got %v", err)
+		}
+	})
+}
+
+func TestTemplateLayouts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/base.html":  {Data: []byte(`<main>{{template "partials/nav.html" .}}{{block "content" .}}empty{{end}}</main>`)},
+		"layouts/admin.html": {Data: []byte(`<admin>{{block "content" .}}{{end}}</admin>`)},
+		"partials/nav.html":  {Data: []byte(`<nav>{{urlFor "about"}}</nav>`)},
+		"pages/about.html":   {Data: []byte(`{{define "content"}}about {{.}}{{end}}`)},
+		"pages/contact.html": {Data: []byte(`{{define "content"}}contact {{.}}{{end}}`)},
+		"pages/plain.html":   {Data: []byte(`plain {{.}}`)},
+	}
+
+	app := NewApp()
+	if err := app.LoadTemplatesWithConfig(fsys, TemplateConfig{DefaultLayout: "layouts/base.html"}); err != nil {
+		t.Fatalf("LoadTemplatesWithConfig failed: %v", err)
+	}
+	render := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := Render(w, r, name, "x"); err != nil {
+				t.Errorf("Render %s failed: %v", name, err)
+			}
+		}
+	}
+	app.Handle("GET /about", render("pages/about.html")).Named("about")
+	app.Handle("GET /contact", render("pages/contact.html"))
+	app.Handle("GET /admin/about", render("pages/about.html")).Layout("layouts/admin.html")
+	app.Handle("GET /plain", func(w http.ResponseWriter, r *http.Request) {
+		RenderLayout(w, r, "", "pages/plain.html", "y")
+	})
+	app.Handle("GET /override", func(w http.ResponseWriter, r *http.Request) {
+		RenderLayout(w, r, "layouts/admin.html", "pages/contact.html", "z")
+	})
+	app.Handle("GET /missing", func(w http.ResponseWriter, r *http.Request) {
+		if err := Render(w, r, "pages/nope.html", nil); err == nil {
+			t.Error("Expected an error for a missing page")
+		}
+	})
+
+	tests := map[string]string{
+		"/about":       `<main><nav>/about</nav>about x</main>`,
+		"/contact":     `<main><nav>/about</nav>contact x</main>`,
+		"/admin/about": `<admin>about x</admin>`,
+		"/plain":       `plain y`,
+		"/override":    `<admin>contact z</admin>`,
+	}
+	for path, expected := range tests {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Body.String() != expected {
+			t.Errorf("%s: expected %q, got %q", path, expected, w.Body.String())
+		}
+	}
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/missing", nil))
+
+	if err := NewApp().LoadTemplatesWithConfig(fsys, TemplateConfig{DefaultLayout: "layouts/nope.html"}); err == nil {
+		t.Error("Expected an error for a missing default layout")
+	}
+}
+
+func TestTemplateReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("layouts/base.html", `<main>{{block "content" .}}{{end}}</main>`)
+	write("pages/home.html", `{{define "content"}}v1{{end}}`)
+
+	app := NewApp()
+	config := TemplateConfig{DefaultLayout: "layouts/base.html", Reload: true, ReloadInterval: time.Nanosecond}
+	if err := app.LoadTemplatesWithConfig(os.DirFS(dir), config); err != nil {
+		t.Fatalf("LoadTemplatesWithConfig failed: %v", err)
+	}
+	app.Handle("GET /", func(w http.ResponseWriter, r *http.Request) {
+		if err := Render(w, r, "pages/home.html", nil); err != nil {
+			t.Errorf("Render failed: %v", err)
+		}
+	})
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	if body := get().Body.String(); body != "<main>v1</main>" {
+		t.Fatalf("Expected v1, got %q", body)
+	}
+
+	write("pages/home.html", `{{define "content"}}version 2{{end}}`)
+	if body := get().Body.String(); body != "<main>version 2</main>" {
+		t.Errorf("Expected the edited page, got %q", body)
+	}
+
+	write("pages/home.html", `{{define "content"}}{{if}}<oops>{{end}}`)
+	w := get()
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "Template error") || !strings.Contains(w.Body.String(), "pages/home.html") {
+		t.Errorf("Expected an error page, got %d %q", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "<oops>") {
+		t.Error("Expected the error page to escape the template source")
+	}
+
+	write("pages/home.html", `{{define "content"}}fixed{{end}}`)
+	if body := get().Body.String(); body != "<main>fixed</main>" {
+		t.Fatalf("Expected the fixed page, got %q", body)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if w := get(); w.Code != http.StatusOK || w.Body.String() != "<main>fixed</main>" {
+					t.Errorf("Unexpected response %d %q", w.Code, w.Body.String())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	write("pages/broken.html", `{{end}}`)
+	if err := NewApp().LoadTemplatesWithConfig(os.DirFS(dir), config); err != nil {
+		t.Errorf("Expected parse errors to be deferred to the browser, got %v", err)
+	}
+}
+
+func TestLoadTemplatesReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) {
+		if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`<p>v1</p>`)
+
+	app := NewApp()
+	if err := app.LoadTemplatesReload(dir, nil); err != nil {
+		t.Fatalf("LoadTemplatesReload failed: %v", err)
+	}
+	app.Handle("GET /", func(w http.ResponseWriter, r *http.Request) {
+		if err := Render(w, r, "index.html", nil); err != nil {
+			t.Errorf("Render failed: %v", err)
+		}
+	})
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+	// Wait out the default interval between checks for changed files.
+	wait := func() { time.Sleep(250 * time.Millisecond) }
+
+	if body := get().Body.String(); body != "<p>v1</p>" {
+		t.Fatalf("Expected v1, got %q", body)
+	}
+
+	write(`<p>version 2</p>`)
+	wait()
+	if body := get().Body.String(); body != "<p>version 2</p>" {
+		t.Errorf("Expected the edited template, got %q", body)
+	}
+
+	write(`{{if}}`)
+	wait()
+	if w := get(); w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "Template error") {
+		t.Errorf("Expected an error page, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRenderStatus(t *testing.T) {
+	t.Run("NoTemplates", func(t *testing.T) {
+		app := NewApp()
+		app.Handle("GET /", func(w http.ResponseWriter, r *http.Request) {
+			if err := Render(w, r, "index.html", nil); !errors.Is(err, ErrNoTemplates) {
+				t.Errorf("Expected ErrNoTemplates, got %v", err)
+			}
+		})
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Body.Len() != 0 {
+			t.Errorf("Expected nothing written, got %q", w.Body.String())
+		}
+	})
+
+	fsys := fstest.MapFS{
+		"layouts/base.html": {Data: []byte("<main>\n{{block \"content\" .}}{{end}}\n{{.Missing}}</main>")},
+		"pages/ok.html":     {Data: []byte(`{{.}}{{define "content"}}ok{{end}}`)},
+		"pages/bad.html":    {Data: []byte("{{define \"content\"}}\nstart\n{{index . 5}}{{end}}")},
+		"pages/attr.html":   {Data: []byte("<a href=\"{{.}}\n{{if .}}\">x</a>{{end}}")},
+	}
+	app := NewApp()
+	if err := app.LoadTemplatesWithConfig(fsys, TemplateConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	var renderErr error
+	app.Handle("GET /{page}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "text/plain")
+		renderErr = RenderStatus(w, r, http.StatusCreated, "pages/"+r.PathValue("page")+".html", "hi")
+	})
+	app.Handle("GET /layout/{page}", func(w http.ResponseWriter, r *http.Request) {
+		renderErr = RenderLayout(w, r, "layouts/base.html", "pages/"+r.PathValue("page")+".html", []int{1})
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		renderErr = nil
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/ok")
+	if renderErr != nil || w.Code != http.StatusCreated || w.Body.String() != "hi" {
+		t.Fatalf("Unexpected response %d %q: %v", w.Code, w.Body.String(), renderErr)
+	}
+	if ct := w.Header().Values("Content-Type"); len(ct) != 1 || ct[0] != "text/html; charset=utf-8" {
+		t.Errorf("Expected a single Content-Type, got %v", ct)
+	}
+	if w.Header().Get("Content-Length") != "2" {
+		t.Errorf("Expected Content-Length 2, got %q", w.Header().Get("Content-Length"))
+	}
+
+	tests := []struct {
+		path string
+		name string
+		line int
+	}{
+		{"/layout/bad", "pages/bad.html", 3},
+		{"/layout/ok", "layouts/base.html", 3},
+		{"/attr", "pages/attr.html", 2},
+		{"/nope", "pages/nope.html", 0},
+	}
+	for _, tt := range tests {
+		w := get(tt.path)
+		var te *TemplateError
+		if !errors.As(renderErr, &te) {
+			t.Errorf("%s: expected a TemplateError, got %v", tt.path, renderErr)
+			continue
+		}
+		if te.Name != tt.name || te.Line != tt.line {
+			t.Errorf("%s: expected %s:%d, got %s:%d (%v)", tt.path, tt.name, tt.line, te.Name, te.Line, te)
+		}
+		if w.Body.Len() != 0 || w.Code != http.StatusOK {
+			t.Errorf("%s: expected nothing written, got %d %q", tt.path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHTMX(t *testing.T) {
+	t.Run("Request", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "/", nil)
+		if IsHTMX(r) || IsHXBoosted(r) {
+			t.Error("Expected a plain request not to be htmx")
+		}
+		r.Header.Set("HX-Request", "true")
+		r.Header.Set("HX-Boosted", "true")
+		r.Header.Set("HX-Target", "rows")
+		r.Header.Set("HX-Trigger", "load-more")
+		r.Header.Set("HX-Current-URL", "http://example.com/users")
+		if !IsHTMX(r) || !IsHXBoosted(r) || HXTarget(r) != "rows" || HXTrigger(r) != "load-more" || HXCurrentURL(r) != "http://example.com/users" {
+			t.Error("Unexpected htmx request values")
+		}
+	})
+
+	t.Run("Response", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		SetHXRedirect(w, "/login")
+		SetHXPushURL(w, "false")
+		SetHXRetarget(w, "#errors")
+		SetHXReswap(w, "outerHTML")
+		SetHXLocation(w, HXLocation{Path: "/users"})
+		h := w.Header()
+		if h.Get("HX-Redirect") != "/login" || h.Get("HX-Push-Url") != "false" || h.Get("HX-Retarget") != "#errors" || h.Get("HX-Reswap") != "outerHTML" || h.Get("HX-Location") != "/users" {
+			t.Errorf("Unexpected headers %v", h)
+		}
+		SetHXLocation(w, HXLocation{Path: "/users", Target: "#main"})
+		if h.Get("HX-Location") != `{"path":"/users","target":"#main"}` {
+			t.Errorf("Unexpected HX-Location %q", h.Get("HX-Location"))
+		}
+
+		h.Set("HX-Trigger", "saved, closeModal")
+		if err := SetHXTrigger(w, "showMessage", map[string]string{"level": "info"}); err != nil {
+			t.Fatal(err)
+		}
+		SetHXTrigger(w, "count", 3)
+		var events map[string]any
+		if err := json.Unmarshal([]byte(h.Get("HX-Trigger")), &events); err != nil {
+			t.Fatalf("Expected JSON in HX-Trigger, got %q", h.Get("HX-Trigger"))
+		}
+		expected := map[string]any{"saved": nil, "closeModal": nil, "showMessage": map[string]any{"level": "info"}, "count": 3.0}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("Expected %v, got %v", expected, events)
+		}
+		if len(h.Values("HX-Trigger")) != 1 {
+			t.Error("Expected a single HX-Trigger header")
+		}
+	})
+
+	t.Run("RenderFragment", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"layouts/base.html": {Data: []byte(`<html>{{block "content" .}}{{end}}</html>`)},
+			"pages/users.html":  {Data: []byte(`{{define "content"}}<ul>{{block "rows" .}}<li>{{.}}</li>{{end}}</ul>{{end}}`)},
+		}
+		app := NewApp()
+		if err := app.LoadTemplatesWithConfig(fsys, TemplateConfig{DefaultLayout: "layouts/base.html"}); err != nil {
+			t.Fatal(err)
+		}
+		app.HandleErr("GET /users", func(w http.ResponseWriter, r *http.Request) error {
+			return RenderFragment(w, r, "pages/users.html", "rows", "ann")
+		})
+
+		tests := []struct {
+			headers  map[string]string
+			expected string
+		}{
+			{nil, "<html><ul><li>ann</li></ul></html>"},
+			{map[string]string{"HX-Request": "true"}, "<li>ann</li>"},
+			{map[string]string{"HX-Request": "true", "HX-Boosted": "true"}, "<html><ul><li>ann</li></ul></html>"},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest("GET", "/users", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, req)
+			if w.Body.String() != tt.expected {
+				t.Errorf("%v: expected %q, got %q", tt.headers, tt.expected, w.Body.String())
+			}
+			if vary := w.Header().Values("Vary"); !reflect.DeepEqual(vary, []string{"HX-Request", "HX-Boosted"}) {
+				t.Errorf("Unexpected Vary %v", vary)
+			}
+		}
+	})
+}
@@ -3,34 +3,120 @@ package vii
 import (
 	"net/http"
 	"strings"
+	"sync"
 )
 
+// Group registers routes under a shared prefix and middleware chain.
+// Middleware runs in the order global → group → subgroup → local.
 type Group struct {
-	parent     *App
+	app        *App
+	parent     *Group
 	prefix     string
+	mu         sync.Mutex // guards middleware and sealed
 	middleware []func(http.Handler) http.Handler
+	sealed     bool
 }
 
 func (app *App) Group(prefix string) *Group {
 	return &Group{
-		parent:     app,
+		app:        app,
 		prefix:     strings.TrimRight(prefix, "/"),
 		middleware: []func(http.Handler) http.Handler{},
 	}
 }
 
+// Group creates a sub-group that inherits this group's prefix and
+// middleware. Its own middleware runs after the parent's.
+func (g *Group) Group(prefix string) *Group {
+	return &Group{
+		app:        g.app,
+		parent:     g,
+		prefix:     g.prefix + strings.TrimRight(prefix, "/"),
+		middleware: []func(http.Handler) http.Handler{},
+	}
+}
+
+// Use adds middleware to the group. It applies to every route in the group
+// and its sub-groups, including routes registered before the call, but must
+// be called before the group serves its first request. Calling it afterwards
+// panics rather than leaving some requests without the middleware.
 func (g *Group) Use(middleware ...func(http.Handler) http.Handler) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sealed {
+		panic("vii: Group.Use called on " + g.prefix + " after it started serving requests")
+	}
 	g.middleware = append(g.middleware, middleware...)
 }
 
-func (g *Group) Handle(path string, handler http.HandlerFunc, middleware ...func(http.Handler) http.Handler) {
-	resolvedPath := g.prefix + strings.TrimRight(strings.Split(path, " ")[1], "/")
-	method := strings.Split(path, " ")[0]
-	// Only apply Group + Local middleware here
-	allMiddleware := append(g.middleware, middleware...)
-	finalHandler := Chain(handler, allMiddleware...)
-	g.parent.Mux.HandleFunc(method+" "+resolvedPath, func(w http.ResponseWriter, r *http.Request) {
-		r = SetContext("GLOBAL", g.parent.GlobalContext, r)
+// Handle registers a handler under the group's prefix. The returned Route
+// records the full path, including the prefix.
+func (g *Group) Handle(path string, handler http.HandlerFunc, middleware ...func(http.Handler) http.Handler) *Route {
+	return g.handle(path, handler, nil, middleware)
+}
+
+// HandleErr registers an error-returning handler under the group's prefix,
+// as App.HandleErr does.
+func (g *Group) HandleErr(path string, handler HandlerFunc, middleware ...func(http.Handler) http.Handler) *Route {
+	return g.handle(path, g.app.errorHandlerFunc(handler), nil, middleware)
+}
+
+// HandleTyped registers a handler created by JSONHandler under the group's
+// prefix, as App.HandleTyped does.
+func (g *Group) HandleTyped(path string, handler *TypedHandler, middleware ...func(http.Handler) http.Handler) *Route {
+	return g.handle(path, g.app.errorHandlerFunc(handler.Handler), handler, middleware)
+}
+
+func (g *Group) handle(path string, handlerFunc http.HandlerFunc, typed *TypedHandler, middleware []func(http.Handler) http.Handler) *Route {
+	method, subPath := splitPattern(path)
+	pattern := g.prefix + strings.TrimRight(subPath, "/")
+	if method != "" {
+		pattern = method + " " + pattern
+	}
+	var (
+		once         sync.Once
+		finalHandler http.Handler
+	)
+	// The route is complete before the mux can serve it, as the handler
+	// reads it.
+	rt := g.app.addRoute(pattern, g, middleware)
+	rt.typed = typed
+	g.app.Mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		// The chain is built on first use so that Group.Use calls made after
+		// registration are still applied.
+		once.Do(func() {
+			// Only apply Group + Local middleware here
+			allMiddleware := append(g.sealMiddleware(), middleware...)
+			finalHandler = Chain(handlerFunc, allMiddleware...)
+		})
+		r = SetContext("GLOBAL", g.app.GlobalContext, r)
+		r = rt.withLayout(r)
 		finalHandler.ServeHTTP(w, r)
 	})
+	return rt
+}
+
+// allMiddleware returns the middleware of every ancestor group followed by
+// this group's own, outermost first.
+func (g *Group) allMiddleware() []func(http.Handler) http.Handler {
+	return g.collectMiddleware(false)
+}
+
+// sealMiddleware is like allMiddleware but also marks the groups as serving,
+// so later Use calls panic.
+func (g *Group) sealMiddleware() []func(http.Handler) http.Handler {
+	return g.collectMiddleware(true)
+}
+
+func (g *Group) collectMiddleware(seal bool) []func(http.Handler) http.Handler {
+	var middleware []func(http.Handler) http.Handler
+	if g.parent != nil {
+		middleware = g.parent.collectMiddleware(seal)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if seal {
+		g.sealed = true
+	}
+	return append(middleware, g.middleware...)
 }
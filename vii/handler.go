@@ -0,0 +1,212 @@
+package vii
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+//=====================================
+// handlers and errors
+//=====================================
+
+// HandlerFunc is a handler that returns an error instead of writing one.
+// Register it with App.HandleErr or Group.HandleErr; returned errors are
+// passed to the handler registered with App.OnError.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// HTTPError is an error that maps to an HTTP status code. Message is shown
+// to the client; Cause is logged for server errors but never sent.
+type HTTPError struct {
+	Status  int
+	Message string
+	Cause   error
+}
+
+// NewHTTPError returns an HTTPError for the status code. If message is empty
+// the standard status text is used.
+func NewHTTPError(status int, message string) *HTTPError {
+	return &HTTPError{Status: status, Message: message}
+}
+
+func (e *HTTPError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.Status)
+	}
+	if e.Cause != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, msg, e.Cause)
+	}
+	return fmt.Sprintf("%d %s", e.Status, msg)
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Cause
+}
+
+// OnError sets the function that turns errors returned by handlers into
+// responses. It replaces DefaultErrorHandler.
+func (app *App) OnError(handler func(w http.ResponseWriter, r *http.Request, err error)) {
+	app.errorHandler = handler
+}
+
+// handleError passes err to the app's error handler.
+func (app *App) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if app.errorHandler != nil {
+		app.errorHandler(w, r, err)
+		return
+	}
+	DefaultErrorHandler(w, r, err)
+}
+
+// DefaultErrorHandler turns an error into a response using ProblemFrom:
+// HTTPErrors, Problems and BodyErrors keep their status, BindErrors become
+// 400 and ValidationErrors 422. Any other error becomes a generic 500, so
+// internal details are never shown to clients. Server errors are logged.
+// Responses are application/problem+json unless the client prefers
+// text/html or text/plain, as browsers do, in which case they are plain
+// text.
+func DefaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	p := ProblemFrom(err)
+	if p.Status >= 500 {
+		log.Printf("vii: %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	addVary(w.Header(), "Accept")
+	if wantsProblem(r) {
+		WriteProblem(w, p)
+		return
+	}
+
+	msg := p.Detail
+	var validationErrs ValidationErrors
+	var bindErr *BindError
+	switch {
+	case errors.As(err, &validationErrs):
+		msg = validationErrs.Error()
+	case errors.As(err, &bindErr):
+		msg = bindErr.Error()
+	}
+	if msg == "" {
+		msg = http.StatusText(p.Status)
+	}
+	http.Error(w, msg, p.Status)
+}
+
+func (app *App) errorHandlerFunc(h HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			app.handleError(w, r, err)
+		}
+	}
+}
+
+// TypedHandler is a handler that knows its request and response types, as
+// created by JSONHandler. Register it with App.HandleTyped or
+// Group.HandleTyped; the types are used when generating API documentation.
+type TypedHandler struct {
+	Handler  HandlerFunc
+	Request  reflect.Type
+	Response reflect.Type
+}
+
+// JSONHandler adapts a typed function into a handler. The request is bound
+// from path, query, header and cookie tags with Bind, decoded from the JSON
+// body with the ReadJSON rules (except for GET, HEAD and DELETE requests),
+// and validated with Validate. Req may be a struct or a pointer to one, in
+// which case fn gets a newly allocated value. The body is not read when
+// every field of Req is bound by Bind or excluded with json:"-", so such
+// requests may omit it. The result is written with WriteJSON and a 200
+// status. Errors from any step, including those returned by fn, are passed
+// to the app's error handler, so an HTTPError or Problem controls the status
+// code. JSONHandler panics if Req has an unknown validation rule or a
+// malformed rule parameter.
+func JSONHandler[Req, Res any](fn func(ctx context.Context, req Req) (Res, error)) *TypedHandler {
+	reqType := reflect.TypeFor[Req]()
+	if err := checkValidation(reqType); err != nil {
+		panic(err.Error())
+	}
+	isPointer := reqType.Kind() == reflect.Pointer && reqType.Elem().Kind() == reflect.Struct
+	structType := reqType
+	if isPointer {
+		structType = reqType.Elem()
+	}
+	isStruct := structType.Kind() == reflect.Struct
+	readsBody := !isStruct || hasJSONFields(structType)
+
+	return &TypedHandler{
+		Request:  reqType,
+		Response: reflect.TypeFor[Res](),
+		Handler: func(w http.ResponseWriter, r *http.Request) error {
+			var req Req
+			// target points at the struct that is bound, decoded and validated.
+			var target any = &req
+			if isPointer {
+				ptr := reflect.New(structType)
+				req = ptr.Interface().(Req)
+				target = req
+			}
+			if isStruct {
+				if err := Bind(r, target); err != nil {
+					return err
+				}
+			}
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodDelete:
+			default:
+				if readsBody {
+					if err := ReadJSONWith(r, w, target, JSONOptions{}); err != nil {
+						return err
+					}
+				}
+			}
+			if isStruct {
+				if err := Validate(target); err != nil {
+					return err
+				}
+			}
+
+			res, err := fn(r.Context(), req)
+			if err != nil {
+				return err
+			}
+			return WriteJSON(w, http.StatusOK, res)
+		},
+	}
+}
+
+// hasJSONFields reports whether a struct has a field decoded from the JSON
+// body, that is an exported field not bound by Bind or tagged json:"-".
+// Embedded structs without a JSON name are searched as their fields are
+// promoted.
+func hasJSONFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if isBoundField(sf) {
+			continue
+		}
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if name, _, _ := strings.Cut(tag, ","); sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if hasJSONFields(ft) {
+					return true
+				}
+				continue
+			}
+		}
+		if sf.IsExported() {
+			return true
+		}
+	}
+	return false
+}
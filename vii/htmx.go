@@ -0,0 +1,131 @@
+package vii
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+//=====================================
+// htmx
+//=====================================
+
+// IsHTMX reports whether the request was made by htmx, which sends
+// HX-Request: true.
+func IsHTMX(r *http.Request) bool {
+	return r.Header.Get("HX-Request") == "true"
+}
+
+// IsHXBoosted reports whether the request comes from an element using
+// hx-boost. Boosted requests expect a whole page.
+func IsHXBoosted(r *http.Request) bool {
+	return r.Header.Get("HX-Boosted") == "true"
+}
+
+// HXTarget returns the id of the target element, if it has one.
+func HXTarget(r *http.Request) string {
+	return r.Header.Get("HX-Target")
+}
+
+// HXTrigger returns the id of the element that triggered the request, if it
+// has one.
+func HXTrigger(r *http.Request) string {
+	return r.Header.Get("HX-Trigger")
+}
+
+// HXCurrentURL returns the URL of the browser when the request was made.
+func HXCurrentURL(r *http.Request) string {
+	return r.Header.Get("HX-Current-URL")
+}
+
+// SetHXRedirect tells htmx to do a full page redirect to url.
+func SetHXRedirect(w http.ResponseWriter, url string) {
+	w.Header().Set("HX-Redirect", url)
+}
+
+// HXLocation describes a client-side navigation for SetHXLocation. Only
+// Path is required; the other fields are the options of htmx.ajax.
+type HXLocation struct {
+	Path    string            `json:"path"`
+	Target  string            `json:"target,omitempty"`
+	Swap    string            `json:"swap,omitempty"`
+	Select  string            `json:"select,omitempty"`
+	Source  string            `json:"source,omitempty"`
+	Event   string            `json:"event,omitempty"`
+	Handler string            `json:"handler,omitempty"`
+	Values  map[string]any    `json:"values,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// SetHXLocation tells htmx to load loc.Path without a full page reload, as
+// if a boosted link was followed.
+func SetHXLocation(w http.ResponseWriter, loc HXLocation) error {
+	if loc.Target == "" && loc.Swap == "" && loc.Select == "" && loc.Source == "" && loc.Event == "" && loc.Handler == "" && loc.Values == nil && loc.Headers == nil {
+		w.Header().Set("HX-Location", loc.Path)
+		return nil
+	}
+	encoded, err := json.Marshal(loc)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Location", string(encoded))
+	return nil
+}
+
+// SetHXPushURL pushes url onto the browser history. Pass "false" to stop
+// htmx from pushing the URL the element asked for.
+func SetHXPushURL(w http.ResponseWriter, url string) {
+	w.Header().Set("HX-Push-Url", url)
+}
+
+// SetHXRetarget swaps the response into the element matching selector
+// instead of the request's target.
+func SetHXRetarget(w http.ResponseWriter, selector string) {
+	w.Header().Set("HX-Retarget", selector)
+}
+
+// SetHXReswap overrides how the response is swapped, e.g. "outerHTML" or
+// "beforeend scroll:bottom".
+func SetHXReswap(w http.ResponseWriter, swap string) {
+	w.Header().Set("HX-Reswap", swap)
+}
+
+// SetHXTrigger makes htmx trigger event on the target element once the
+// response arrives, with detail as the event's detail, encoded as JSON. A
+// detail that is not a JSON object is available as detail.value. Call it
+// once per event; the events are combined into one HX-Trigger header.
+func SetHXTrigger(w http.ResponseWriter, event string, detail any) error {
+	events := map[string]any{}
+	if existing := w.Header().Get("HX-Trigger"); existing != "" {
+		if json.Unmarshal([]byte(existing), &events) != nil {
+			// A plain list of event names.
+			for _, name := range strings.Split(existing, ",") {
+				events[strings.TrimSpace(name)] = nil
+			}
+		}
+	}
+	events[event] = detail
+	encoded, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Trigger", string(encoded))
+	return nil
+}
+
+// RenderFragment renders just the {{define}} block named block of a page
+// for htmx requests, and the whole page as Render would otherwise. Boosted
+// requests get the whole page, since htmx swaps in its body. It adds
+// HX-Request and HX-Boosted to Vary, so caches keep the two apart.
+//
+//	{{define "content"}}<div id="rows">{{block "rows" .}}...{{end}}</div>{{end}}
+//
+//	vii.RenderFragment(w, r, "pages/users.html", "rows", users)
+func RenderFragment(w http.ResponseWriter, r *http.Request, name, block string, data any) error {
+	addVary(w.Header(), "HX-Request")
+	addVary(w.Header(), "HX-Boosted")
+	if IsHTMX(r) && !IsHXBoosted(r) {
+		return renderStatus(w, r, http.StatusOK, name, &block, data)
+	}
+	return renderStatus(w, r, http.StatusOK, name, nil, data)
+}
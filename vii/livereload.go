@@ -0,0 +1,58 @@
+package vii
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"time"
+)
+
+//=====================================
+// live reload
+//=====================================
+
+// LiveReloadConfig holds the configuration for LiveReloadWithConfig.
+type LiveReloadConfig struct {
+	// Path is the server-sent events endpoint browsers listen on. Defaults
+	// to "/_vii/livereload".
+	Path string
+	// Interval is how often watched directories are polled for changes.
+	// Defaults to 300ms.
+	Interval time.Duration
+}
+
+// liveReloadHeader marks a response as a page that gets the live reload
+// script. The middleware removes it before the response is sent.
+const liveReloadHeader = "X-Vii-Live-Reload"
+
+// LiveReload returns the live reload middleware with the default
+// LiveReloadConfig. Install it with app.Use in development:
+//
+//	app.Use(app.LiveReload())
+//
+// It polls the directories given to the template loaders and ServeDir, and
+// serves a server-sent events endpoint at LiveReloadConfig.Path that tells
+// browsers when files change. Pages written with Render, RenderLayout,
+// WriteHTML or Respond get a small script before </body> that listens to
+// it: the page reloads when anything changes, or only its stylesheets are
+// refetched when just .css files changed. Embedded files from ServeFS and
+// embed.FS templates are not watched. Pair it with TemplateConfig.Reload so
+// the reloaded page uses the edited templates. Only responses that pass
+// through the middleware are marked for the script, and polling stops when
+// the app shuts down.
+//
+// Live reload is only compiled into builds with the dev tag, as in
+// go run -tags dev. In other builds the middleware does nothing and pages
+// are left untouched.
+func (app *App) LiveReload() func(http.Handler) http.Handler {
+	return app.LiveReloadWithConfig(LiveReloadConfig{})
+}
+
+// watchFiles records a directory of templates or static files for LiveReload
+// to watch. Embedded files never change, so an embed.FS is not recorded.
+func (app *App) watchFiles(fileSystem fs.FS) {
+	if _, ok := fileSystem.(embed.FS); ok {
+		return
+	}
+	app.watched = append(app.watched, fileSystem)
+}
@@ -0,0 +1,277 @@
+//go:build dev
+
+package vii
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// LiveReloadWithConfig returns the live reload middleware. It is only
+// compiled into builds with the dev tag.
+func (app *App) LiveReloadWithConfig(config LiveReloadConfig) func(http.Handler) http.Handler {
+	if config.Path == "" {
+		config.Path = "/_vii/livereload"
+	}
+	if config.Interval <= 0 {
+		config.Interval = 300 * time.Millisecond
+	}
+	lr := &liveReloader{
+		app:    app,
+		config: config,
+		broker: NewBroker(BrokerConfig{HistorySize: -1}),
+		stop:   make(chan struct{}),
+		script: liveReloadScript(config.Path),
+	}
+	// Stop watching when the app shuts down, even if it is served by a
+	// server it did not start.
+	app.OnShutdown(func(ctx context.Context) error {
+		lr.close()
+		return nil
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lr.start.Do(lr.run)
+			if r.URL.Path == config.Path {
+				lr.serveEvents(w, r)
+				return
+			}
+			lw := &liveReloadWriter{ResponseWriter: w, script: lr.script}
+			defer lw.finish()
+			next.ServeHTTP(lw, r)
+		})
+	}
+}
+
+// markLiveReload marks a page for the live reload script if the response
+// passes through a live reload middleware, found by following Unwrap. The
+// middleware removes the mark, so it never reaches the client.
+func markLiveReload(w http.ResponseWriter) {
+	for inner := w; inner != nil; {
+		if _, ok := inner.(*liveReloadWriter); ok {
+			w.Header().Set(liveReloadHeader, "1")
+			return
+		}
+		u, ok := inner.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return
+		}
+		inner = u.Unwrap()
+	}
+}
+
+// liveReloader polls the app's template and ServeDir directories and tells
+// connected browsers when they change.
+type liveReloader struct {
+	app       *App
+	config    LiveReloadConfig
+	broker    *Broker
+	start     sync.Once
+	stop      chan struct{}
+	closeOnce sync.Once
+	script    []byte
+}
+
+// run starts polling. It happens on the first request, once the templates
+// and static directories have been registered, and stops when the app or
+// its server shuts down.
+func (lr *liveReloader) run() {
+	lr.app.serverMu.Lock()
+	if lr.app.server != nil {
+		lr.app.server.RegisterOnShutdown(lr.close)
+	}
+	lr.app.serverMu.Unlock()
+	go lr.watch(lr.app.watched)
+}
+
+func (lr *liveReloader) close() {
+	lr.closeOnce.Do(func() { close(lr.stop) })
+}
+
+func (lr *liveReloader) watch(dirs []fs.FS) {
+	stamps := make([]map[string]fileStamp, len(dirs))
+	for i, dir := range dirs {
+		stamps[i], _ = scanFiles(dir)
+	}
+	ticker := time.NewTicker(lr.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-lr.stop:
+			return
+		case <-ticker.C:
+		}
+		var changed []string
+		for i, dir := range dirs {
+			current, _ := scanFiles(dir)
+			changed = append(changed, changedFiles(stamps[i], current)...)
+			stamps[i] = current
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		event := "css"
+		for _, name := range changed {
+			if path.Ext(name) != ".css" {
+				event = "reload"
+				break
+			}
+		}
+		lr.broker.Publish("livereload", Event{Event: event, Data: changed})
+	}
+}
+
+// changedFiles lists the files added, removed or modified between two scans.
+func changedFiles(before, after map[string]fileStamp) []string {
+	var changed []string
+	for name, stamp := range after {
+		if old, ok := before[name]; !ok || !old.modTime.Equal(stamp.modTime) || old.size != stamp.size {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// serveEvents streams change events to one browser until it disconnects or
+// the server shuts down.
+func (lr *liveReloader) serveEvents(w http.ResponseWriter, r *http.Request) {
+	stream, err := SSE(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer stream.Close()
+	sub := lr.broker.Subscribe("", "livereload")
+	defer sub.Close()
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case <-lr.stop:
+			return
+		case e, ok := <-sub.Events():
+			if !ok || stream.Send(e) != nil {
+				return
+			}
+		}
+	}
+}
+
+// liveReloadScript returns the script injected into pages. It reloads the
+// page on a "reload" event and on reconnecting after the server restarts,
+// and swaps stylesheets in place on a "css" event.
+func liveReloadScript(endpoint string) []byte {
+	quoted, _ := json.Marshal(endpoint)
+	return []byte(`<script>
+(function () {
+	var source = new EventSource(` + string(quoted) + `), lost = false;
+	source.onerror = function () { lost = true; };
+	source.onopen = function () { if (lost) location.reload(); };
+	source.addEventListener("reload", function () { location.reload(); });
+	source.addEventListener("css", function () {
+		document.querySelectorAll('link[rel="stylesheet"]').forEach(function (link) {
+			var url = new URL(link.href);
+			url.searchParams.set("vii-reload", Date.now());
+			link.href = url.href;
+		});
+	});
+})();
+</script>
+`)
+}
+
+// liveReloadWriter inserts the live reload script before </body> in
+// responses marked with markLiveReload. Other responses pass through.
+type liveReloadWriter struct {
+	http.ResponseWriter
+	script      []byte
+	wroteHeader bool
+	inject      bool
+	injected    bool
+	held        []byte // the end of the output, which may hold a partial </body>
+}
+
+var closingBody = []byte("</body>")
+
+func (lw *liveReloadWriter) WriteHeader(code int) {
+	if lw.wroteHeader {
+		lw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h := lw.Header()
+	if code >= 200 {
+		lw.wroteHeader = true
+		if h.Get(liveReloadHeader) != "" && h.Get("Content-Encoding") == "" {
+			lw.inject = true
+			h.Del("Content-Length")
+		}
+	}
+	h.Del(liveReloadHeader)
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *liveReloadWriter) Write(b []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if !lw.inject || lw.injected {
+		return lw.ResponseWriter.Write(b)
+	}
+	data := append(lw.held, b...)
+	lw.held = nil
+	if i := bytes.Index(bytes.ToLower(data), closingBody); i >= 0 {
+		lw.injected = true
+		out := make([]byte, 0, len(data)+len(lw.script))
+		out = append(append(append(out, data[:i]...), lw.script...), data[i:]...)
+		if _, err := lw.ResponseWriter.Write(out); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	keep := min(len(data), len(closingBody)-1)
+	lw.held = append([]byte(nil), data[len(data)-keep:]...)
+	if _, err := lw.ResponseWriter.Write(data[:len(data)-keep]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// FlushError sends any held output before flushing, so a streamed page is
+// not reordered. A </body> split across the flush is then missed.
+func (lw *liveReloadWriter) FlushError() error {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if len(lw.held) > 0 {
+		held := lw.held
+		lw.held = nil
+		if _, err := lw.ResponseWriter.Write(held); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+func (lw *liveReloadWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// finish writes output still held back when the handler returns.
+func (lw *liveReloadWriter) finish() {
+	if len(lw.held) > 0 {
+		lw.ResponseWriter.Write(lw.held)
+		lw.held = nil
+	}
+}
@@ -0,0 +1,125 @@
+//go:build dev
+
+package vii
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveReload(t *testing.T) {
+	templates, static := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(templates, "index.html"), []byte(`<html><body>{{.}}</BODY></html>`), 0o644)
+	os.WriteFile(filepath.Join(static, "site.css"), []byte(`body {}`), 0o644)
+
+	app := NewApp()
+	app.Use(app.LiveReloadWithConfig(LiveReloadConfig{Interval: 10 * time.Millisecond}))
+	if err := app.LoadTemplatesWithConfig(os.DirFS(templates), TemplateConfig{Reload: true, ReloadInterval: time.Nanosecond}); err != nil {
+		t.Fatal(err)
+	}
+	app.ServeDir("/static", static)
+	app.Handle("GET /", func(w http.ResponseWriter, r *http.Request) {
+		Render(w, r, "index.html", "hello")
+	})
+	app.Handle("GET /split", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "40")
+		markLiveReload(w)
+		w.Write([]byte("<body>a</bo"))
+		w.Write([]byte("dy>"))
+	})
+	app.Handle("GET /json", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, "</body>")
+	})
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var b strings.Builder
+		bufio.NewReader(resp.Body).WriteTo(&b)
+		return resp, b.String()
+	}
+
+	resp, body := get("/")
+	if !strings.Contains(body, `new EventSource("/_vii/livereload")`) || !strings.HasSuffix(body, "</script>\n</BODY></html>") {
+		t.Errorf("Expected the script before </body>, got %q", body)
+	}
+	if resp.Header.Get(liveReloadHeader) != "" {
+		t.Error("Expected the marker header to be removed")
+	}
+	if _, body := get("/split"); !strings.HasPrefix(body, "<body>a<script>") || !strings.HasSuffix(body, "</body>") {
+		t.Errorf("Expected the script before a split </body>, got %q", body)
+	}
+	if _, body := get("/json"); strings.Contains(body, "<script>") {
+		t.Errorf("Expected JSON untouched, got %q", body)
+	}
+	if _, body := get("/static/site.css"); body != "body {}" {
+		t.Errorf("Expected static files untouched, got %q", body)
+	}
+
+	events, err := http.Get(server.URL + "/_vii/livereload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+	lines := bufio.NewScanner(events.Body)
+	next := func() string {
+		for lines.Scan() {
+			if event, ok := strings.CutPrefix(lines.Text(), "event: "); ok {
+				return event
+			}
+		}
+		return ""
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	os.WriteFile(filepath.Join(static, "site.css"), []byte(`body { color: red }`), 0o644)
+	if event := next(); event != "css" {
+		t.Errorf("Expected a css event, got %q", event)
+	}
+	os.WriteFile(filepath.Join(templates, "index.html"), []byte(`<html><body>{{.}}!</body></html>`), 0o644)
+	if event := next(); event != "reload" {
+		t.Errorf("Expected a reload event, got %q", event)
+	}
+	if _, body := get("/"); !strings.Contains(body, "hello!") {
+		t.Errorf("Expected the edited template, got %q", body)
+	}
+
+	// Another app in the process without the middleware is left alone.
+	other := NewApp()
+	other.Handle("GET /", func(w http.ResponseWriter, r *http.Request) {
+		WriteHTML(w, http.StatusOK, "<body></body>")
+	})
+	w := httptest.NewRecorder()
+	other.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get(liveReloadHeader) != "" || strings.Contains(w.Body.String(), "<script>") {
+		t.Errorf("Expected a page without live reload, got %v %q", w.Header(), w.Body.String())
+	}
+
+	// Shutting the app down stops the watcher and ends open streams.
+	ended := make(chan struct{})
+	go func() {
+		for lines.Scan() {
+		}
+		close(ended)
+	}()
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Error("Expected Shutdown to end the event stream")
+	}
+}
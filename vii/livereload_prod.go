@@ -0,0 +1,15 @@
+//go:build !dev
+
+package vii
+
+import "net/http"
+
+// LiveReloadWithConfig is compiled out of builds without the dev tag: the
+// middleware it returns passes requests straight through.
+func (app *App) LiveReloadWithConfig(config LiveReloadConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return next
+	}
+}
+
+func markLiveReload(w http.ResponseWriter) {}
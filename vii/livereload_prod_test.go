@@ -0,0 +1,29 @@
+//go:build !dev
+
+package vii
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLiveReloadDisabled(t *testing.T) {
+	app := NewApp()
+	app.Use(app.LiveReload())
+	app.Handle("GET /", func(w http.ResponseWriter, r *http.Request) {
+		WriteHTML(w, http.StatusOK, "<html><body>hi</body></html>")
+	})
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Body.String() != "<html><body>hi</body></html>" || w.Header().Get(liveReloadHeader) != "" {
+		t.Errorf("Expected the page untouched, got %q %v", w.Body.String(), w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/_vii/livereload", nil))
+	if w.Header().Get("Content-Type") == "text/event-stream" {
+		t.Error("Expected no live reload endpoint")
+	}
+}
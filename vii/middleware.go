@@ -1,10 +1,12 @@
 package vii
 
 import (
+	"errors"
 	"fmt"
+	"html"
+	"log"
 	"net/http"
-	"strings"
-	"sync"
+	"runtime/debug"
 	"time"
 )
 
@@ -21,85 +23,6 @@ func Chain(h http.HandlerFunc, middleware ...func(http.Handler) http.Handler) ht
 	return finalHandler
 }
 
-// RateLimiterConfig holds the configuration for the rate limiter.
-type RateLimiterConfig struct {
-	Limit      int           // Number of requests allowed per window.
-	Window     time.Duration // The time window.
-	MaxClients int           // Max number of unique clients to track.
-}
-
-// RateLimiter is a middleware that provides rate limiting based on IP address.
-func RateLimiter(config RateLimiterConfig) func(http.Handler) http.Handler {
-	// Set sensible defaults if not provided
-	if config.Limit <= 0 {
-		config.Limit = 20
-	}
-	if config.Window <= 0 {
-		config.Window = 1 * time.Minute
-	}
-	if config.MaxClients <= 0 {
-		config.MaxClients = 1000
-	}
-
-	var (
-		mu       sync.Mutex
-		requests = make(map[string][]time.Time)
-		queue    = make([]string, 0, config.MaxClients)
-	)
-
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			mu.Lock()
-
-			// Get client IP. Note: r.RemoteAddr may not be the true client IP if behind a proxy.
-			// In a production environment, you might want to check X-Forwarded-For or other headers.
-			ip := strings.Split(r.RemoteAddr, ":")[0]
-
-			// Eviction logic for new clients when the map is full
-			if _, exists := requests[ip]; !exists && len(queue) >= config.MaxClients {
-				evictIP := queue[0]
-				queue = queue[1:]
-				delete(requests, evictIP)
-			}
-
-			// If the client is new, add them to the queue
-			if _, exists := requests[ip]; !exists {
-				queue = append(queue, ip)
-			}
-
-			// Clean up old requests for the current IP
-			now := time.Now()
-			var recentRequests []time.Time
-			for _, t := range requests[ip] {
-				if now.Sub(t) < config.Window {
-					recentRequests = append(recentRequests, t)
-				}
-			}
-			requests[ip] = recentRequests
-
-			// Check if the limit is exceeded
-			if len(requests[ip]) >= config.Limit {
-				mu.Unlock()
-				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-				return
-			}
-
-			// Add the current request timestamp
-			requests[ip] = append(requests[ip], now)
-
-			mu.Unlock()
-
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
-func Timeout(seconds int) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.TimeoutHandler(next, time.Duration(seconds)*time.Second, "Request timed out")
-	}
-}
-
 func Logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
@@ -109,6 +32,9 @@ func Logger(next http.Handler) http.Handler {
 	})
 }
 
+// CORS is a permissive development preset that reflects any Origin and
+// allows credentials. Use CORSWithConfig for anything reachable by browsers
+// with real user sessions.
 func CORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
@@ -127,3 +53,71 @@ func CORS(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RecoverConfig holds the configuration for the panic recovery middleware.
+type RecoverConfig struct {
+	// OnPanic is called with the recovered value and stack trace after the
+	// panic has been logged. It must not write to the response.
+	OnPanic func(r *http.Request, value any, stack []byte)
+	// Dev renders the panic value and stack trace as an HTML page instead of
+	// a plain 500. Never enable it in production.
+	Dev bool
+}
+
+// Recover is a middleware that turns panics into 500 responses using the
+// default RecoverConfig.
+func Recover(next http.Handler) http.Handler {
+	return RecoverWithConfig(RecoverConfig{})(next)
+}
+
+// RecoverWithConfig returns a middleware that recovers from panics in later
+// handlers, logs the value and stack, and writes a 500 if the response has
+// not started. If headers were already sent the connection is aborted so the
+// client doesn't mistake a truncated body for a complete one. Panics with
+// http.ErrAbortHandler are passed through untouched.
+func RecoverWithConfig(config RecoverConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := newResponseWriter(w)
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+					panic(v)
+				}
+				stack := debug.Stack()
+				log.Printf("vii: panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, stack)
+				if config.OnPanic != nil {
+					config.OnPanic(r, v, stack)
+				}
+				if rw.wroteHeader {
+					panic(http.ErrAbortHandler)
+				}
+				if config.Dev {
+					writePanicPage(rw, v, stack)
+					return
+				}
+				http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// writePanicPage renders a recovered panic as an HTML page for development.
+func writePanicPage(w http.ResponseWriter, value any, stack []byte) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>panic: %[1]s</title></head>
+<body style="font-family: monospace; margin: 2rem;">
+<h1 style="color: #b00020;">panic: %[1]s</h1>
+<pre style="background: #f5f5f5; padding: 1rem; overflow-x: auto;">%[2]s</pre>
+</body>
+</html>
+`, html.EscapeString(fmt.Sprint(value)), html.EscapeString(string(stack)))
+}
@@ -1,8 +1,13 @@
 package vii
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -55,4 +60,384 @@ func TestTimeoutMiddleware(t *testing.T) {
 			t.Errorf("Expected status Service Unavailable (503), got %v", resp.Status)
 		}
 	})
+
+	t.Run("ResponseController", func(t *testing.T) {
+		handler := Timeout(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Errorf("SetWriteDeadline failed: %v", err)
+			}
+		}))
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+	})
+
+	t.Run("HijackLiftsDeadline", func(t *testing.T) {
+		handler := TimeoutWithConfig(TimeoutConfig{Duration: 50 * time.Millisecond})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Errorf("Hijack failed: %v", err)
+				return
+			}
+			defer conn.Close()
+			time.Sleep(100 * time.Millisecond)
+			if r.Context().Err() != nil {
+				t.Errorf("Expected the deadline to be lifted, got %v", r.Context().Err())
+			}
+			brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nHijacked")
+			brw.Flush()
+		}))
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "Hijacked" {
+			t.Errorf("Unexpected response %d %q", resp.StatusCode, body)
+		}
+	})
+}
+
+func TestNestedGroups(t *testing.T) {
+	var callOrder []string
+	record := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				callOrder = append(callOrder, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	app := NewApp()
+	app.Use(record("global"))
+
+	api := app.Group("/api")
+	api.Use(record("group"))
+	v1 := api.Group("/v1")
+	admin := v1.Group("/admin/")
+
+	admin.Handle("GET /users", func(w http.ResponseWriter, r *http.Request) {
+		callOrder = append(callOrder, "handler")
+	}, record("local"))
+
+	// Middleware added after the route was registered still applies.
+	admin.Use(record("subgroup"))
+
+	req := httptest.NewRequest("GET", "/api/v1/admin/users", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+
+	expected := []string{"global", "group", "subgroup", "local", "handler"}
+	if strings.Join(callOrder, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected order %v, got %v", expected, callOrder)
+	}
+
+	routes := app.Routes()
+	if routes[0].Path != "/api/v1/admin/users" || routes[0].Prefix != "/api/v1/admin" {
+		t.Errorf("Unexpected route: %+v", routes[0])
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected Use after serving to panic")
+		}
+	}()
+	api.Use(record("late"))
+}
+
+func TestGroupUseDuringFirstRequest(t *testing.T) {
+	app := NewApp()
+	api := app.Group("/api")
+	api.Handle("GET /ping", func(w http.ResponseWriter, r *http.Request) {})
+	noop := func(next http.Handler) http.Handler { return next }
+
+	start, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { recover() }() // Use panics once the group is serving.
+		<-start
+		for i := 0; i < 1000; i++ {
+			api.Use(noop)
+		}
+	}()
+	close(start)
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/ping", nil))
+	<-done
+}
+
+func TestRecover(t *testing.T) {
+	t.Run("WritesInternalServerError", func(t *testing.T) {
+		var hookValue any
+		mw := RecoverWithConfig(RecoverConfig{
+			OnPanic: func(r *http.Request, value any, stack []byte) {
+				hookValue = value
+				if len(stack) == 0 {
+					t.Error("Expected a stack trace")
+				}
+			},
+		})
+		handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status 500, got %d", w.Code)
+		}
+		if hookValue != "boom" {
+			t.Errorf("Expected hook to receive 'boom', got %v", hookValue)
+		}
+	})
+
+	t.Run("DevPage", func(t *testing.T) {
+		handler := RecoverWithConfig(RecoverConfig{Dev: true})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("<script>")
+		}))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if !strings.Contains(w.Body.String(), "panic: &lt;script&gt;") {
+			t.Errorf("Expected escaped panic value in page, got '%s'", w.Body.String())
+		}
+	})
+
+	t.Run("HeadersAlreadySent", func(t *testing.T) {
+		handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("partial"))
+			panic("late")
+		}))
+
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("Expected http.ErrAbortHandler, got %v", v)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	})
+
+	t.Run("ErrAbortHandlerPassesThrough", func(t *testing.T) {
+		called := false
+		handler := RecoverWithConfig(RecoverConfig{
+			OnPanic: func(r *http.Request, value any, stack []byte) { called = true },
+		})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("Expected http.ErrAbortHandler, got %v", v)
+			}
+			if called {
+				t.Error("OnPanic should not run for http.ErrAbortHandler")
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	})
+}
+
+func TestCORSWithConfig(t *testing.T) {
+	handler := CORSWithConfig(CORSConfig{
+		AllowOrigins:     []string{"https://app.example.com", "https://*.example.org"},
+		AllowOriginFunc:  func(origin string) bool { return origin == "http://localhost:3000" },
+		AllowMethods:     []string{"GET", "POST"},
+		ExposeHeaders:    []string{"X-Total"},
+		MaxAge:           10 * time.Minute,
+		AllowCredentials: true,
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	serve := func(method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("AllowedOrigins", func(t *testing.T) {
+		for _, origin := range []string{"https://app.example.com", "https://a.b.example.org", "http://localhost:3000"} {
+			w := serve("GET", origin, nil)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != origin {
+				t.Errorf("Expected Allow-Origin '%s', got '%s'", origin, got)
+			}
+			if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+				t.Errorf("Expected Allow-Credentials for %s", origin)
+			}
+			if w.Header().Get("Access-Control-Expose-Headers") != "X-Total" {
+				t.Errorf("Expected Expose-Headers for %s", origin)
+			}
+			if w.Header().Get("Vary") != "Origin" {
+				t.Errorf("Expected Vary: Origin, got '%s'", w.Header().Get("Vary"))
+			}
+		}
+	})
+
+	t.Run("DisallowedOrigin", func(t *testing.T) {
+		for _, origin := range []string{"https://evil.com", "https://example.org", "https://evil.com/.example.org"} {
+			w := serve("GET", origin, nil)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+				t.Errorf("Expected no Allow-Origin for %s, got '%s'", origin, got)
+			}
+			if w.Body.String() != "ok" {
+				t.Errorf("Expected request to reach handler for %s", origin)
+			}
+		}
+	})
+
+	t.Run("Preflight", func(t *testing.T) {
+		w := serve("OPTIONS", "https://app.example.com", map[string]string{
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "content-type",
+		})
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", w.Code)
+		}
+		if w.Header().Get("Access-Control-Allow-Methods") != "GET, POST" {
+			t.Errorf("Unexpected Allow-Methods '%s'", w.Header().Get("Access-Control-Allow-Methods"))
+		}
+		if w.Header().Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("Expected Max-Age 600, got '%s'", w.Header().Get("Access-Control-Max-Age"))
+		}
+	})
+
+	t.Run("FailedPreflight", func(t *testing.T) {
+		cases := []struct {
+			origin  string
+			headers map[string]string
+		}{
+			{"https://evil.com", map[string]string{"Access-Control-Request-Method": "GET"}},
+			{"https://app.example.com", map[string]string{"Access-Control-Request-Method": "DELETE"}},
+			{"https://app.example.com", map[string]string{"Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "X-Secret"}},
+		}
+		for _, tc := range cases {
+			w := serve("OPTIONS", tc.origin, tc.headers)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("Expected status 403 for %v, got %d", tc, w.Code)
+			}
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Errorf("Expected no CORS headers for %v", tc)
+			}
+		}
+	})
+
+	t.Run("WildcardWithCredentialsPanics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected panic for '*' with AllowCredentials")
+			}
+		}()
+		CORSWithConfig(CORSConfig{AllowOrigins: []string{"*"}, AllowCredentials: true})
+	})
+}
+
+func TestLoggerWithConfig(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	})
+
+	t.Run("Structured", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+		mw := LoggerWithConfig(LoggerConfig{Logger: logger, SkipPaths: []string{"/healthz"}})
+
+		req := httptest.NewRequest("POST", "/items", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Request-ID", "abc")
+		mw(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("Expected a JSON log record, got '%s'", buf.String())
+		}
+		if record["status"] != float64(201) || record["bytes"] != float64(5) {
+			t.Errorf("Expected status 201 and 5 bytes, got %v", record)
+		}
+		if record["ip"] != "192.0.2.1" || record["request_id"] != "abc" || record["path"] != "/items" {
+			t.Errorf("Unexpected record %v", record)
+		}
+
+		buf.Reset()
+		mw(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+		if buf.Len() != 0 {
+			t.Errorf("Expected /healthz to be skipped, got '%s'", buf.String())
+		}
+	})
+
+	t.Run("Combined", func(t *testing.T) {
+		var buf bytes.Buffer
+		mw := LoggerWithConfig(LoggerConfig{Format: LogFormatCombined, Output: &buf})
+
+		req := httptest.NewRequest("GET", "/a?b=c", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "curl/8.0")
+		mw(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		line := buf.String()
+		if !strings.HasPrefix(line, "192.0.2.1 - - [") {
+			t.Errorf("Unexpected line start '%s'", line)
+		}
+		if !strings.HasSuffix(line, `] "GET /a?b=c HTTP/1.1" 201 5 "-" "curl/8.0"`+"\n") {
+			t.Errorf("Unexpected line '%s'", line)
+		}
+	})
+
+	t.Run("Escaping", func(t *testing.T) {
+		var buf bytes.Buffer
+		mw := LoggerWithConfig(LoggerConfig{Format: LogFormatCombined, Output: &buf})
+
+		req := httptest.NewRequest("GET", "/a", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "say \"hi\"\x01 é")
+		mw(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		if !strings.HasSuffix(buf.String(), `"GET /a HTTP/1.1" 201 5 "-" "say \"hi\"\x01 é"`+"\n") {
+			t.Errorf("Unexpected line '%s'", buf.String())
+		}
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+		mw := LoggerWithConfig(LoggerConfig{Logger: logger})
+		panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected the panic to propagate")
+				}
+			}()
+			mw(panicking).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/boom", nil))
+		}()
+
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("Expected a JSON log record, got '%s'", buf.String())
+		}
+		if record["status"] != float64(500) || record["level"] != "ERROR" {
+			t.Errorf("Expected an error record with status 500, got %v", record)
+		}
+	})
 }
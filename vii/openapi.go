@@ -0,0 +1,714 @@
+package vii
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//=====================================
+// openapi
+//=====================================
+
+// OpenAPIConfig holds the document metadata for App.OpenAPI.
+type OpenAPIConfig struct {
+	// Title defaults to "API".
+	Title string
+	// Version is the version of the API, not of OpenAPI. Defaults to "1.0.0".
+	Version     string
+	Description string
+	// Servers lists base URLs, such as "https://api.example.com".
+	Servers []string
+}
+
+// OpenAPIDocument is an OpenAPI 3.1 document. Marshal it with encoding/json
+// or call YAML.
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Servers    []OpenAPIServer                         `json:"servers,omitempty"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components,omitzero"`
+}
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenAPIServer struct {
+	URL string `json:"url"`
+}
+
+type OpenAPIComponents struct {
+	Schemas map[string]*JSONSchema `json:"schemas,omitempty"`
+}
+
+// OpenAPIOperation documents a single route.
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId,omitempty"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses,omitempty"`
+}
+
+type OpenAPIParameter struct {
+	Name     string      `json:"name"`
+	In       string      `json:"in"` // "path", "query", "header" or "cookie"
+	Required bool        `json:"required,omitempty"`
+	Schema   *JSONSchema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required,omitempty"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *JSONSchema `json:"schema"`
+}
+
+// JSONSchema is the subset of JSON Schema used to describe Go types.
+type JSONSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 any                    `json:"type,omitempty"` // a string, or []string when nullable
+	Format               string                 `json:"format,omitempty"`
+	Enum                 []any                  `json:"enum,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	AdditionalProperties *JSONSchema            `json:"additionalProperties,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+}
+
+// OpenAPI builds an OpenAPI 3.1 document from the routes registered so far.
+// Path parameters come from ServeMux wildcards and query parameters from
+// Route.WithURL. Routes registered with JSONHandler also document their
+// request body, bound parameters and response from the Go types, using json
+// tags for property names and validate tags for constraints. Named struct
+// types are shared under components/schemas. Routes without a method and
+// static file routes are left out.
+func (app *App) OpenAPI(config OpenAPIConfig) *OpenAPIDocument {
+	if config.Title == "" {
+		config.Title = "API"
+	}
+	if config.Version == "" {
+		config.Version = "1.0.0"
+	}
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.1.0",
+		Info: OpenAPIInfo{
+			Title:       config.Title,
+			Version:     config.Version,
+			Description: config.Description,
+		},
+		Paths: map[string]map[string]*OpenAPIOperation{},
+	}
+	for _, server := range config.Servers {
+		doc.Servers = append(doc.Servers, OpenAPIServer{URL: server})
+	}
+
+	gen := &schemaGenerator{names: map[reflect.Type]string{}, schemas: map[string]*JSONSchema{}}
+	for _, rt := range app.routes {
+		// Typed routes reference the error schema, so claim its name before
+		// any user type can.
+		if rt.typed != nil && !rt.hidden {
+			gen.schemas["Problem"] = problemSchema
+			break
+		}
+	}
+	for _, rt := range app.routes {
+		if rt.hidden || rt.Method == "" {
+			continue
+		}
+		path := openAPIPath(rt.Path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*OpenAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(rt.Method)] = gen.operation(rt)
+	}
+	if len(gen.schemas) > 0 {
+		doc.Components.Schemas = gen.schemas
+	}
+	return doc
+}
+
+// YAML returns the document encoded as YAML, with keys in the same order as
+// the JSON encoding.
+func (doc *OpenAPIDocument) YAML() ([]byte, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return jsonToYAML(data)
+}
+
+// ServeOpenAPI registers a GET route that serves the app's OpenAPI document.
+// Paths ending in ".yaml" or ".yml" are served as YAML, anything else as
+// JSON. The document is built on the first request, so it covers routes
+// registered after ServeOpenAPI. The route itself is not documented.
+func (app *App) ServeOpenAPI(path string, config OpenAPIConfig, middleware ...func(http.Handler) http.Handler) *Route {
+	asYAML := strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml")
+	var (
+		once sync.Once
+		body []byte
+		err  error
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) error {
+		once.Do(func() {
+			doc := app.OpenAPI(config)
+			if asYAML {
+				body, err = doc.YAML()
+			} else {
+				body, err = json.MarshalIndent(doc, "", "  ")
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if asYAML {
+			w.Header().Set("Content-Type", "application/yaml")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, writeErr := w.Write(body)
+		return writeErr
+	}
+	rt := app.HandleErr("GET "+path, handler, middleware...)
+	rt.hidden = true
+	return rt
+}
+
+// openAPIPath converts a ServeMux path to an OpenAPI path template:
+// "{name...}" becomes "{name}" and "{$}" is dropped.
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		name, _, ok := parseWildcard(segment)
+		if !ok {
+			continue
+		}
+		if name == "$" {
+			segments[i] = ""
+		} else {
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// schemaGenerator converts Go types to schemas, collecting named struct
+// types as shared components.
+type schemaGenerator struct {
+	names   map[reflect.Type]string
+	schemas map[string]*JSONSchema
+}
+
+func (gen *schemaGenerator) operation(rt *Route) *OpenAPIOperation {
+	op := &OpenAPIOperation{OperationID: rt.Name}
+
+	// Parameters declared by the request type take precedence, since they
+	// carry a real type; wildcards and WithURL keys fill in the rest as strings.
+	var params []OpenAPIParameter
+	var reqType reflect.Type
+	if rt.typed != nil {
+		// JSONHandler binds a pointer request type through its element.
+		reqType = rt.typed.Request
+		if reqType.Kind() == reflect.Pointer && reqType.Elem().Kind() == reflect.Struct {
+			reqType = reqType.Elem()
+		}
+	}
+	if reqType != nil && reqType.Kind() == reflect.Struct {
+		params = gen.boundParameters(reqType, params)
+	}
+	for _, name := range NewURL(rt.Path).PathParams {
+		params = addParameter(params, OpenAPIParameter{Name: name, In: "path", Required: true, Schema: &JSONSchema{Type: "string"}})
+	}
+	for _, name := range rt.query {
+		params = addParameter(params, OpenAPIParameter{Name: name, In: "query", Schema: &JSONSchema{Type: "string"}})
+	}
+	op.Parameters = params
+
+	if rt.typed == nil {
+		return op
+	}
+	if body := gen.requestBodySchema(reqType); body != nil {
+		switch rt.Method {
+		case http.MethodGet, http.MethodHead, http.MethodDelete:
+		default:
+			op.RequestBody = &OpenAPIRequestBody{
+				Required: true,
+				Content:  map[string]OpenAPIMediaType{"application/json": {Schema: body}},
+			}
+		}
+	}
+	op.Responses = map[string]*OpenAPIResponse{
+		"200": {
+			Description: http.StatusText(http.StatusOK),
+			Content:     map[string]OpenAPIMediaType{"application/json": {Schema: gen.schema(rt.typed.Response)}},
+		},
+		"default": {
+			Description: "Error",
+			Content:     map[string]OpenAPIMediaType{"application/problem+json": {Schema: &JSONSchema{Ref: "#/components/schemas/Problem"}}},
+		},
+	}
+	return op
+}
+
+// addParameter appends p unless a parameter with the same name and location
+// is already present.
+func addParameter(params []OpenAPIParameter, p OpenAPIParameter) []OpenAPIParameter {
+	for _, existing := range params {
+		if existing.Name == p.Name && existing.In == p.In {
+			return params
+		}
+	}
+	return append(params, p)
+}
+
+// boundParameters adds a parameter for every path, query, header and cookie
+// tag that Bind would read from t.
+func (gen *schemaGenerator) boundParameters(t reflect.Type, params []OpenAPIParameter) []OpenAPIParameter {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		tagged := false
+		for _, src := range bindSources {
+			name, ok := sf.Tag.Lookup(src)
+			if !ok || name == "" || name == "-" {
+				continue
+			}
+			tagged = true
+			if src == "form" {
+				continue
+			}
+			schema := gen.schema(sf.Type)
+			gen.applyRules(schema, sf.Tag.Get("validate"))
+			params = addParameter(params, OpenAPIParameter{
+				Name:     name,
+				In:       src,
+				Required: src == "path" || hasRule(sf.Tag.Get("validate"), "required"),
+				Schema:   schema,
+			})
+		}
+		if !tagged && isNestedStruct(sf.Type) {
+			params = gen.boundParameters(sf.Type, params)
+		}
+	}
+	return params
+}
+
+// requestBodySchema returns the schema of the JSON body for a request type,
+// or nil if it has none. Fields filled by Bind are not part of the body.
+func (gen *schemaGenerator) requestBodySchema(t reflect.Type) *JSONSchema {
+	if t.Kind() != reflect.Struct {
+		return gen.schema(t)
+	}
+	if t.NumField() == 0 {
+		return nil
+	}
+	if !hasBoundFields(t) {
+		return gen.schema(t)
+	}
+	schema := &JSONSchema{Type: "object"}
+	gen.addProperties(schema, t, true)
+	if len(schema.Properties) == 0 {
+		return nil
+	}
+	return schema
+}
+
+func hasBoundFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if isBoundField(t.Field(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBoundField(sf reflect.StructField) bool {
+	for _, src := range bindSources {
+		if name, ok := sf.Tag.Lookup(src); ok && name != "" && name != "-" {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+	rawMessageType    = reflect.TypeFor[json.RawMessage]()
+)
+
+// schema returns the schema for t, registering named structs as components
+// and returning a reference to them.
+func (gen *schemaGenerator) schema(t reflect.Type) *JSONSchema {
+	switch t {
+	case timeType:
+		return &JSONSchema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &JSONSchema{}
+	}
+	if t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface {
+		if t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType) {
+			return &JSONSchema{}
+		}
+		if t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+			return &JSONSchema{Type: "string"}
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := gen.schema(t.Elem())
+		if typ, ok := schema.Type.(string); ok {
+			schema.Type = []string{typ, "null"}
+		}
+		return schema
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return &JSONSchema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64:
+		return &JSONSchema{Type: "integer", Format: "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		zero := 0.0
+		return &JSONSchema{Type: "integer", Minimum: &zero}
+	case reflect.Float32:
+		return &JSONSchema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &JSONSchema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return &JSONSchema{Type: "string", Format: "byte"}
+		}
+		return &JSONSchema{Type: "array", Items: gen.schema(t.Elem())}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: gen.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			schema := &JSONSchema{Type: "object"}
+			gen.addProperties(schema, t, false)
+			return schema
+		}
+		name, ok := gen.names[t]
+		if !ok {
+			name = gen.componentName(t)
+			gen.names[t] = name
+			schema := &JSONSchema{Type: "object"}
+			gen.schemas[name] = schema
+			gen.addProperties(schema, t, false)
+		}
+		return &JSONSchema{Ref: "#/components/schemas/" + name}
+	default:
+		// Interfaces, and kinds encoding/json cannot represent, accept anything.
+		return &JSONSchema{}
+	}
+}
+
+var componentNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// componentName picks a unique component key for a named type.
+func (gen *schemaGenerator) componentName(t reflect.Type) string {
+	base := strings.Trim(componentNameUnsafe.ReplaceAllString(t.Name(), "_"), "_")
+	name := base
+	for i := 2; ; i++ {
+		if _, taken := gen.schemas[name]; !taken {
+			return name
+		}
+		name = base + strconv.Itoa(i)
+	}
+}
+
+// addProperties adds the JSON fields of struct t to schema, following the
+// encoding/json rules for names, omitted fields and embedded structs.
+func (gen *schemaGenerator) addProperties(schema *JSONSchema, t reflect.Type, skipBound bool) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if skipBound && isBoundField(sf) {
+			continue
+		}
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				gen.addProperties(schema, ft, skipBound)
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+
+		var prop *JSONSchema
+		if strings.Contains(opts, "string") && isScalarKind(sf.Type.Kind()) {
+			prop = &JSONSchema{Type: "string"}
+		} else {
+			prop = gen.schema(sf.Type)
+		}
+		rules := sf.Tag.Get("validate")
+		gen.applyRules(prop, rules)
+		if schema.Properties == nil {
+			schema.Properties = map[string]*JSONSchema{}
+		}
+		schema.Properties[name] = prop
+		if hasRule(rules, "required") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+func isScalarKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// applyRules maps the built-in validate rules onto schema keywords. Rules on
+// referenced schemas are ignored, since siblings of $ref would change the
+// shared component.
+func (gen *schemaGenerator) applyRules(schema *JSONSchema, rules string) {
+	if rules == "" || rules == "-" || schema.Ref != "" {
+		return
+	}
+	typ, _ := schema.Type.(string)
+	if types, ok := schema.Type.([]string); ok {
+		typ = types[0]
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, param, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "min", "max", "len":
+			n, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				continue
+			}
+			count := int(n)
+			switch typ {
+			case "string":
+				if name != "max" {
+					schema.MinLength = &count
+				}
+				if name != "min" {
+					schema.MaxLength = &count
+				}
+			case "array":
+				if name != "max" {
+					schema.MinItems = &count
+				}
+				if name != "min" {
+					schema.MaxItems = &count
+				}
+			case "integer", "number":
+				if name != "max" {
+					schema.Minimum = &n
+				}
+				if name != "min" {
+					schema.Maximum = &n
+				}
+			}
+		case "email":
+			schema.Format = "email"
+		case "url":
+			schema.Format = "uri"
+		case "oneof":
+			for _, option := range strings.Fields(param) {
+				if typ == "integer" || typ == "number" {
+					if n, err := strconv.ParseFloat(option, 64); err == nil {
+						schema.Enum = append(schema.Enum, n)
+						continue
+					}
+				}
+				schema.Enum = append(schema.Enum, option)
+			}
+		}
+	}
+}
+
+func hasRule(rules, name string) bool {
+	for _, rule := range strings.Split(rules, ",") {
+		if r, _, _ := strings.Cut(strings.TrimSpace(rule), "="); r == name {
+			return true
+		}
+	}
+	return false
+}
+
+// problemSchema describes the RFC 9457 bodies written by DefaultErrorHandler.
+var problemSchema = &JSONSchema{
+	Type: "object",
+	Properties: map[string]*JSONSchema{
+		"type":     {Type: "string", Format: "uri-reference"},
+		"title":    {Type: "string"},
+		"status":   {Type: "integer"},
+		"detail":   {Type: "string"},
+		"instance": {Type: "string", Format: "uri-reference"},
+		"errors": {Type: "array", Items: &JSONSchema{
+			Type: "object",
+			Properties: map[string]*JSONSchema{
+				"field":   {Type: "string"},
+				"source":  {Type: "string"},
+				"rule":    {Type: "string"},
+				"param":   {Type: "string"},
+				"value":   {Type: "string"},
+				"message": {Type: "string"},
+			},
+		}},
+	},
+}
+
+// jsonToYAML re-encodes a JSON document as block-style YAML, keeping the
+// order of object keys. Strings are double-quoted unless they are plainly
+// safe, and JSON escapes are valid in YAML double-quoted strings.
+func jsonToYAML(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	node, err := readYAMLNode(dec)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	node.write(&buf, 0)
+	return buf.Bytes(), nil
+}
+
+// yamlNode is a JSON value with object keys kept in document order.
+type yamlNode struct {
+	kind   json.Delim // '{', '[' or 0 for scalars
+	keys   []string
+	items  []*yamlNode
+	scalar string
+}
+
+func readYAMLNode(dec *json.Decoder) (*yamlNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		node := &yamlNode{kind: v}
+		for dec.More() {
+			if v == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+			item, err := readYAMLNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			node.items = append(node.items, item)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &yamlNode{scalar: yamlString(v)}, nil
+	case nil:
+		return &yamlNode{scalar: "null"}, nil
+	default:
+		return &yamlNode{scalar: fmt.Sprint(v)}, nil
+	}
+}
+
+// inline reports whether the node is written on the same line as its key.
+func (n *yamlNode) inline() bool {
+	return n.kind == 0 || len(n.items) == 0
+}
+
+func (n *yamlNode) inlineValue() string {
+	switch {
+	case n.kind == '{':
+		return "{}"
+	case n.kind == '[':
+		return "[]"
+	default:
+		return n.scalar
+	}
+}
+
+func (n *yamlNode) write(w *bytes.Buffer, indent int) {
+	pad := strings.Repeat(" ", indent)
+	if n.inline() {
+		fmt.Fprintf(w, "%s%s\n", pad, n.inlineValue())
+		return
+	}
+	for i, item := range n.items {
+		if n.kind == '{' {
+			fmt.Fprintf(w, "%s%s:", pad, yamlString(n.keys[i]))
+			if item.inline() {
+				fmt.Fprintf(w, " %s\n", item.inlineValue())
+			} else {
+				io.WriteString(w, "\n")
+				item.write(w, indent+2)
+			}
+			continue
+		}
+		// Sequence items are written as if nested, then the indentation of
+		// their first line is replaced by the "- " marker.
+		var nested bytes.Buffer
+		item.write(&nested, indent+2)
+		fmt.Fprintf(w, "%s- %s", pad, nested.Bytes()[indent+2:])
+	}
+}
+
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/$][A-Za-z0-9_./$+-]*$`)
+
+// yamlString returns s unquoted when YAML would read it back as the same
+// string, and double-quoted otherwise.
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "y", "n", "null", "~":
+		return strconv.Quote(s)
+	}
+	if yamlPlain.MatchString(s) {
+		return s
+	}
+	b, _ := json.Marshal(s)
+	return string(b)
+}
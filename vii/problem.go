@@ -0,0 +1,166 @@
+package vii
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+//=====================================
+// problem details (RFC 9457)
+//=====================================
+
+// Problem is an RFC 9457 problem details object. It implements error, so
+// handlers can return it directly. Extensions are written as additional
+// top-level members; they cannot replace the standard ones.
+type Problem struct {
+	Type       string         `json:"type,omitempty"`
+	Title      string         `json:"title,omitempty"`
+	Status     int            `json:"status,omitempty"`
+	Detail     string         `json:"detail,omitempty"`
+	Instance   string         `json:"instance,omitempty"`
+	Extensions map[string]any `json:"-"`
+}
+
+// NewProblem returns a Problem for the status code, titled with the
+// standard status text.
+func NewProblem(status int, detail string) *Problem {
+	return &Problem{
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	members := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		members[k] = v
+	}
+	type standard Problem
+	b, err := json.Marshal((*standard)(p))
+	if err != nil {
+		return nil, err
+	}
+	var std map[string]any
+	if err := json.Unmarshal(b, &std); err != nil {
+		return nil, err
+	}
+	for k, v := range std {
+		members[k] = v
+	}
+	return json.Marshal(members)
+}
+
+// WriteProblem writes p as an application/problem+json response. A zero
+// Status is written as 500.
+func WriteProblem(w http.ResponseWriter, p *Problem) error {
+	status := p.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(p)
+}
+
+// ProblemFrom converts an error into a Problem. Problems, HTTPErrors,
+// BodyErrors, BindErrors and ValidationErrors keep their status and details,
+// with field errors listed under the "errors" extension. Any other error
+// becomes a generic 500 that reveals nothing about the cause. A zero status
+// is returned as 500, so the result can always be written.
+func ProblemFrom(err error) *Problem {
+	p := problemFrom(err)
+	if p.Status != 0 {
+		return p
+	}
+	// Copy rather than modify a Problem the caller may still hold.
+	withStatus := *p
+	withStatus.Status = http.StatusInternalServerError
+	if withStatus.Title == "" {
+		withStatus.Title = http.StatusText(withStatus.Status)
+	}
+	return &withStatus
+}
+
+func problemFrom(err error) *Problem {
+	var (
+		problem        *Problem
+		validationErrs ValidationErrors
+		bindErr        *BindError
+		bodyErr        *BodyError
+		httpErr        *HTTPError
+	)
+	switch {
+	case errors.As(err, &problem):
+		return problem
+	case errors.As(err, &validationErrs):
+		p := NewProblem(http.StatusUnprocessableEntity, "The request failed validation.")
+		p.Extensions = map[string]any{"errors": []FieldError(validationErrs)}
+		return p
+	case errors.As(err, &bindErr):
+		p := NewProblem(http.StatusBadRequest, "The request parameters are invalid.")
+		p.Extensions = map[string]any{"errors": bindErr.Fields}
+		return p
+	case errors.As(err, &bodyErr):
+		p := NewProblem(bodyErr.Status, bodyErr.Msg)
+		if bodyErr.Field != "" || bodyErr.Offset > 0 {
+			p.Extensions = map[string]any{}
+			if bodyErr.Field != "" {
+				p.Extensions["field"] = bodyErr.Field
+			}
+			if bodyErr.Offset > 0 {
+				p.Extensions["offset"] = bodyErr.Offset
+			}
+		}
+		return p
+	case errors.As(err, &httpErr):
+		return NewProblem(httpErr.Status, httpErr.Message)
+	default:
+		return NewProblem(http.StatusInternalServerError, "")
+	}
+}
+
+// ErrorResponder writes an error response on behalf of a middleware, such as
+// RateLimiter or Timeout.
+type ErrorResponder func(w http.ResponseWriter, r *http.Request, status int, message string)
+
+// PlainError is an ErrorResponder that writes a text/plain body with
+// http.Error. It is the default for built-in middleware.
+func PlainError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	http.Error(w, message, status)
+}
+
+// ProblemError is an ErrorResponder that writes an application/problem+json
+// body.
+func ProblemError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	p := NewProblem(status, message)
+	p.Instance = r.URL.Path
+	WriteProblem(w, p)
+}
+
+// errorMediaTypes are the error formats DefaultErrorHandler chooses between.
+// Problem details come first, so they win ties and answer clients that send
+// no Accept header or */*.
+var errorMediaTypes = []registeredResponder{
+	{mediaType: "application/problem+json"},
+	{mediaType: "application/json"},
+	{mediaType: "text/html"},
+	{mediaType: "text/plain"},
+}
+
+// wantsProblem reports whether to answer with problem details rather than
+// plain text, which is only used when the client prefers text/html or
+// text/plain.
+func wantsProblem(r *http.Request) bool {
+	best, ok := negotiate(r.Header.Values("Accept"), errorMediaTypes)
+	return !ok || strings.HasPrefix(best.mediaType, "application/")
+}
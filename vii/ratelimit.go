@@ -0,0 +1,289 @@
+package vii
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//=====================================
+// rate limiting
+//=====================================
+
+// RateLimitAlgorithm selects how the in-memory store counts requests.
+type RateLimitAlgorithm int
+
+const (
+	// SlidingWindow weights the previous window's count by how much of it
+	// still overlaps the sliding window. It uses two counters per client.
+	SlidingWindow RateLimitAlgorithm = iota
+	// TokenBucket refills Limit tokens per Window, allowing bursts up to Limit.
+	TokenBucket
+)
+
+// RateLimitResult is the outcome of a single rate limit check.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // Time until the client's quota is fully restored.
+	RetryAfter time.Duration // Time until the next request would be allowed, when denied.
+}
+
+// RateLimitStore records requests per key and decides whether they are
+// allowed. Implement it to share limits across processes, e.g. in Redis.
+type RateLimitStore interface {
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error)
+}
+
+// RateLimiterConfig holds the configuration for the rate limiter.
+type RateLimiterConfig struct {
+	Limit      int                // Number of requests allowed per window.
+	Window     time.Duration      // The time window.
+	MaxClients int                // Max number of unique clients the default store tracks.
+	Algorithm  RateLimitAlgorithm // Algorithm used by the default store.
+	// KeyFunc identifies the client for a request. It defaults to the client
+	// IP; if it returns "" the client IP is used as well.
+	KeyFunc func(r *http.Request) string
+	// TrustedProxies lists proxy IPs or CIDR ranges whose Forwarded and
+	// X-Forwarded-For headers are used to find the client IP.
+	TrustedProxies []string
+	// Store defaults to an in-memory store built from MaxClients and Algorithm.
+	Store RateLimitStore
+	// ErrorResponder writes the 429 response. Defaults to PlainError; use
+	// ProblemError for application/problem+json.
+	ErrorResponder ErrorResponder
+}
+
+// RateLimiter is a middleware that limits how many requests each client may
+// make per window. It sets RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy on every response, and Retry-After on
+// 429 responses. If the store fails, the request is logged and allowed.
+func RateLimiter(config RateLimiterConfig) func(http.Handler) http.Handler {
+	// Set sensible defaults if not provided
+	if config.Limit <= 0 {
+		config.Limit = 20
+	}
+	if config.Window <= 0 {
+		config.Window = 1 * time.Minute
+	}
+	if config.MaxClients <= 0 {
+		config.MaxClients = 1000
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryStore(config.Algorithm, config.MaxClients)
+	}
+	if config.ErrorResponder == nil {
+		config.ErrorResponder = PlainError
+	}
+	trusted, err := ParseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		panic("vii: invalid RateLimiterConfig.TrustedProxies: " + err.Error())
+	}
+	policy := fmt.Sprintf("%d;w=%d", config.Limit, int(math.Ceil(config.Window.Seconds())))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := ""
+			if config.KeyFunc != nil {
+				key = config.KeyFunc(r)
+			}
+			if key == "" {
+				key = ClientIP(r, trusted)
+			}
+
+			result, err := config.Store.Allow(r.Context(), key, config.Limit, config.Window)
+			if err != nil {
+				log.Printf("vii: rate limit store: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			h.Set("RateLimit-Policy", policy)
+
+			if !result.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				config.ErrorResponder(w, r, http.StatusTooManyRequests, "Too Many Requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// KeyByHeader returns a KeyFunc that identifies clients by a request header,
+// such as an API key. Requests without the header fall back to the client IP.
+func KeyByHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
+
+// MemoryStore is the default in-process RateLimitStore. It tracks at most
+// maxClients keys, evicting clients whose state has fully reset and, when
+// still full, the least recently seen client.
+type MemoryStore struct {
+	mu         sync.Mutex
+	algorithm  RateLimitAlgorithm
+	maxClients int
+	clients    map[string]*list.Element
+	lru        *list.List // Front is most recently seen.
+	now        func() time.Time
+}
+
+type memoryEntry struct {
+	key      string
+	lastSeen time.Time
+	idleTTL  time.Duration
+
+	// Sliding window counter state.
+	windowStart time.Time
+	prev, curr  int
+
+	// Token bucket state.
+	tokens float64
+}
+
+// NewMemoryStore returns an in-memory store using the given algorithm.
+func NewMemoryStore(algorithm RateLimitAlgorithm, maxClients int) *MemoryStore {
+	return &MemoryStore{
+		algorithm:  algorithm,
+		maxClients: maxClients,
+		clients:    make(map[string]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// Allow records a request for key and reports whether it is within limit.
+func (s *MemoryStore) Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.evictIdle(now)
+
+	var entry *memoryEntry
+	if el, ok := s.clients[key]; ok {
+		entry = el.Value.(*memoryEntry)
+		s.lru.MoveToFront(el)
+	} else {
+		if s.maxClients > 0 && s.lru.Len() >= s.maxClients {
+			oldest := s.lru.Back()
+			s.lru.Remove(oldest)
+			delete(s.clients, oldest.Value.(*memoryEntry).key)
+		}
+		entry = &memoryEntry{key: key, lastSeen: now, tokens: float64(limit)}
+		s.clients[key] = s.lru.PushFront(entry)
+	}
+
+	var result RateLimitResult
+	if s.algorithm == TokenBucket {
+		result = entry.takeToken(now, limit, window)
+		entry.idleTTL = window
+	} else {
+		result = entry.slideWindow(now, limit, window)
+		entry.idleTTL = 2 * window
+	}
+	entry.lastSeen = now
+	return result, nil
+}
+
+// evictIdle drops clients whose counters would have fully reset by now.
+func (s *MemoryStore) evictIdle(now time.Time) {
+	for el := s.lru.Back(); el != nil; {
+		entry := el.Value.(*memoryEntry)
+		if now.Sub(entry.lastSeen) < entry.idleTTL {
+			return
+		}
+		prev := el.Prev()
+		s.lru.Remove(el)
+		delete(s.clients, entry.key)
+		el = prev
+	}
+}
+
+func (e *memoryEntry) slideWindow(now time.Time, limit int, window time.Duration) RateLimitResult {
+	start := now.Truncate(window)
+	if !start.Equal(e.windowStart) {
+		if start.Sub(e.windowStart) == window {
+			e.prev = e.curr
+		} else {
+			e.prev = 0
+		}
+		e.curr = 0
+		e.windowStart = start
+	}
+
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(window)
+	estimate := float64(e.prev)*weight + float64(e.curr)
+	result := RateLimitResult{Limit: limit}
+
+	if estimate+1 > float64(limit) {
+		result.RetryAfter = e.slidingRetryAfter(elapsed, limit, window)
+	} else {
+		e.curr++
+		result.Allowed = true
+		result.Remaining = max(0, int(float64(limit)-estimate-1))
+	}
+
+	// Requests in this window keep counting until the end of the next one.
+	result.Reset = window - elapsed
+	if e.curr > 0 {
+		result.Reset += window
+	}
+	return result
+}
+
+// slidingRetryAfter returns how long until the estimate leaves room for one
+// more request.
+func (e *memoryEntry) slidingRetryAfter(elapsed time.Duration, limit int, window time.Duration) time.Duration {
+	room := float64(limit - 1)
+	if float64(e.curr) <= room && e.prev > 0 {
+		// Wait in this window for the previous window's weight to decay.
+		frac := 1 - (room-float64(e.curr))/float64(e.prev)
+		return time.Duration(frac*float64(window)) - elapsed
+	}
+	// Wait for the next window, where curr becomes prev and decays.
+	untilNext := window - elapsed
+	if e.curr == 0 {
+		return untilNext
+	}
+	frac := max(0, 1-room/float64(e.curr))
+	return untilNext + time.Duration(frac*float64(window))
+}
+
+func (e *memoryEntry) takeToken(now time.Time, limit int, window time.Duration) RateLimitResult {
+	rate := float64(limit) / float64(window)
+	e.tokens = math.Min(float64(limit), e.tokens+float64(now.Sub(e.lastSeen))*rate)
+	result := RateLimitResult{Limit: limit}
+	if e.tokens < 1 {
+		result.RetryAfter = time.Duration((1 - e.tokens) / rate)
+		result.Reset = time.Duration((float64(limit) - e.tokens) / rate)
+		return result
+	}
+	e.tokens--
+	result.Allowed = true
+	result.Remaining = int(e.tokens)
+	result.Reset = time.Duration((float64(limit) - e.tokens) / rate)
+	return result
+}
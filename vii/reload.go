@@ -0,0 +1,141 @@
+package vii
+
+import (
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//=====================================
+// template reloading
+//=====================================
+
+// templateReloader re-parses templates when the files they were loaded from
+// change. Changes are found by polling modification times, at most once per
+// interval and only when a template is rendered. Requests read the current
+// templates through an atomic pointer, so a reload never races with
+// rendering.
+type templateReloader struct {
+	fileSystem fs.FS
+	interval   time.Duration
+	// parse loads the templates, as a *TemplateSet or a *template.Template.
+	parse   func() (any, error)
+	current atomic.Pointer[loadedTemplates]
+
+	mu        sync.Mutex // held while checking for changes
+	nextCheck time.Time
+	stamps    map[string]fileStamp
+}
+
+// loadedTemplates is the result of one parse: the templates, or the error
+// that prevented it.
+type loadedTemplates struct {
+	templates any
+	err       error
+}
+
+func newTemplateReloader(fileSystem fs.FS, interval time.Duration, parse func() (any, error)) *templateReloader {
+	if interval <= 0 {
+		interval = 200 * time.Millisecond
+	}
+	rl := &templateReloader{fileSystem: fileSystem, interval: interval, parse: parse}
+	rl.stamps, _ = scanFiles(fileSystem)
+	rl.reload()
+	rl.nextCheck = time.Now().Add(interval)
+	return rl
+}
+
+// templates returns the current templates, re-parsing them first if files
+// changed. While another request is checking, the previous ones are used.
+func (rl *templateReloader) templates() (any, error) {
+	if rl.mu.TryLock() {
+		if now := time.Now(); !now.Before(rl.nextCheck) {
+			stamps, err := scanFiles(rl.fileSystem)
+			if err != nil || !sameStamps(stamps, rl.stamps) {
+				rl.stamps = stamps
+				rl.reload()
+			}
+			rl.nextCheck = time.Now().Add(rl.interval)
+		}
+		rl.mu.Unlock()
+	}
+	loaded := rl.current.Load()
+	return loaded.templates, loaded.err
+}
+
+func (rl *templateReloader) reload() {
+	templates, err := rl.parse()
+	rl.current.Store(&loadedTemplates{templates: templates, err: err})
+}
+
+// fileStamp is what scanFiles records to tell whether a file changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// scanFiles records the modification time and size of every file in
+// fileSystem. Files in an embed.FS have no modification time, so they
+// never appear to change.
+func scanFiles(fileSystem fs.FS) (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp)
+	err := fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		return nil
+	})
+	return stamps, err
+}
+
+func sameStamps(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, stamp := range a {
+		other, ok := b[path]
+		if !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadError is returned while reloaded templates fail to parse, for the
+// caller that owns the response to show with writeReloadError.
+type reloadError struct {
+	err error
+}
+
+func (e *reloadError) Error() string { return e.err.Error() }
+func (e *reloadError) Unwrap() error { return e.err }
+
+// writeReloadError shows a failed reload in the browser as a 500 page. It
+// returns nil, so the handler doesn't write an error of its own on top.
+func writeReloadError(rw http.ResponseWriter, err error) error {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	markLiveReload(rw)
+	rw.WriteHeader(http.StatusInternalServerError)
+	_, writeErr := io.WriteString(rw, `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Template error</title></head>
+<body style="font-family: sans-serif; margin: 2rem">
+<h1 style="color: #b00020">Template error</h1>
+<pre style="background: #f6f6f6; padding: 1rem; white-space: pre-wrap">`+template.HTMLEscapeString(err.Error())+`</pre>
+<p>Fix the template and reload the page.</p>
+</body></html>
+`)
+	return writeErr
+}
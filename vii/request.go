@@ -5,61 +5,151 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/netip"
+	"reflect"
+	"strings"
 )
 
 //=====================================
 // request helpers
 //=====================================
 
+// JSONOptions configures ReadJSONWith. The zero value matches ReadJSON.
+type JSONOptions struct {
+	MaxBytes           int64 // Maximum body size. Defaults to 1MB.
+	AllowUnknownFields bool  // Ignore object keys with no matching field instead of failing.
+	UseNumber          bool  // Decode numbers into json.Number instead of float64.
+	RequireContentType bool  // Reject bodies not sent as application/json (or +json) with 415.
+	Validate           bool  // Run Validate on the decoded value.
+}
+
+// BodyError describes a request body that could not be decoded. Status is
+// the HTTP status to answer with: 400 for malformed bodies, 413 for bodies
+// over the size limit and 415 for the wrong Content-Type. Field and Offset
+// locate the problem when known.
+type BodyError struct {
+	Status int
+	Field  string
+	Offset int64
+	Msg    string
+	Err    error
+}
+
+func (e *BodyError) Error() string {
+	return e.Msg
+}
+
+func (e *BodyError) Unwrap() error {
+	return e.Err
+}
+
 // ReadJSON decodes the JSON body of a request into the provided interface.
 // It returns an error if the body is empty, malformed, or too large.
+//
+// ReadJSON has no ResponseWriter, so a body over the limit is rejected but
+// the connection is left open and the server may read the rest of the body
+// before reusing it. Handlers that accept untrusted uploads should call
+// ReadJSONWith(r, w, v, JSONOptions{}) instead.
 func ReadJSON(r *http.Request, v interface{}) error {
+	return ReadJSONWith(r, nil, v, JSONOptions{})
+}
+
+// ReadJSONWith decodes the JSON body of a request into v using opts. Pass
+// the ResponseWriter so an oversized body also closes the connection.
+// Decoding problems are returned as *BodyError; validation failures (with
+// opts.Validate) as ValidationErrors.
+func ReadJSONWith(r *http.Request, w http.ResponseWriter, v any, opts JSONOptions) error {
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("ReadJSON requires a non-nil pointer, got %T", v)
+	}
+	if opts.RequireContentType && !isJSONContentType(r.Header.Get("Content-Type")) {
+		return &BodyError{Status: http.StatusUnsupportedMediaType, Msg: "Content-Type must be application/json"}
+	}
+
 	// Set a max body size to prevent malicious attacks
-	maxBytes := 1_048_576 // 1MB
-	r.Body = http.MaxBytesReader(nil, r.Body, int64(maxBytes))
+	maxBytes := opts.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = 1_048_576 // 1MB
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
 	dec := json.NewDecoder(r.Body)
-	dec.DisallowUnknownFields()
+	if !opts.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if opts.UseNumber {
+		dec.UseNumber()
+	}
 
-	err := dec.Decode(v)
-	if err != nil {
-		// Handle specific JSON-related errors
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err, dec)
+	}
 
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+	// Ensure the body is only read once.
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return decodeError(err, dec)
+		}
+		return &BodyError{Status: http.StatusBadRequest, Offset: dec.InputOffset(), Msg: "body must only contain a single JSON value", Err: err}
+	}
 
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+	if opts.Validate {
+		return Validate(v)
+	}
+	return nil
+}
 
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+// decodeError converts an error from json.Decoder into a *BodyError.
+func decodeError(err error, dec *json.Decoder) error {
+	// Handle specific JSON-related errors
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var maxBytesError *http.MaxBytesError
 
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+	switch {
+	case errors.As(err, &syntaxError):
+		return &BodyError{Status: http.StatusBadRequest, Offset: syntaxError.Offset, Err: err,
+			Msg: fmt.Sprintf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)}
 
-		case errors.As(err, &invalidUnmarshalError):
-			panic(err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &BodyError{Status: http.StatusBadRequest, Offset: dec.InputOffset(), Err: err,
+			Msg: "body contains badly-formed JSON"}
 
-		default:
-			return err
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return &BodyError{Status: http.StatusBadRequest, Field: unmarshalTypeError.Field, Offset: unmarshalTypeError.Offset, Err: err,
+				Msg: fmt.Sprintf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)}
 		}
-	}
+		return &BodyError{Status: http.StatusBadRequest, Offset: unmarshalTypeError.Offset, Err: err,
+			Msg: fmt.Sprintf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)}
 
-	// Ensure the body is only read once.
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must only contain a single JSON value")
+	case errors.Is(err, io.EOF):
+		return &BodyError{Status: http.StatusBadRequest, Err: err, Msg: "body must not be empty"}
+
+	case errors.As(err, &maxBytesError):
+		return &BodyError{Status: http.StatusRequestEntityTooLarge, Err: err,
+			Msg: fmt.Sprintf("body must not be larger than %d bytes", maxBytesError.Limit)}
+
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &BodyError{Status: http.StatusBadRequest, Field: field, Offset: dec.InputOffset(), Err: err,
+			Msg: fmt.Sprintf("body contains unknown field %q", field)}
+
+	default:
+		return &BodyError{Status: http.StatusBadRequest, Offset: dec.InputOffset(), Err: err, Msg: err.Error()}
 	}
+}
 
-	return nil
+// isJSONContentType reports whether a Content-Type header names JSON.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
 }
 
 // Header returns the value of a request header.
@@ -81,3 +171,91 @@ func Query(r *http.Request, paramName string) string {
 func QueryIs(r *http.Request, paramName string, valueToCheck string) bool {
 	return r.URL.Query().Get(paramName) == valueToCheck
 }
+
+// ParseTrustedProxies parses IP addresses and CIDR ranges (e.g. "10.0.0.0/8")
+// for use with ClientIP.
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// ClientIP returns the IP address of the client that made the request.
+// Forwarding headers (Forwarded, then X-Forwarded-For) are only honoured when
+// the request arrived from a trusted proxy; they are read right to left and
+// the first address that isn't itself a trusted proxy is returned.
+func ClientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	remote := parseIP(r.RemoteAddr)
+	if !remote.IsValid() {
+		return r.RemoteAddr
+	}
+	if !isTrusted(remote, trustedProxies) {
+		return remote.String()
+	}
+
+	var chain []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, strings.Trim(value, `"`))
+				}
+			}
+		}
+	} else {
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			chain = append(chain, strings.Split(value, ",")...)
+		}
+	}
+
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr := parseIP(strings.TrimSpace(chain[i]))
+		if !addr.IsValid() {
+			break
+		}
+		client = addr
+		if !isTrusted(addr, trustedProxies) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// parseIP parses an address with an optional port, as found in RemoteAddr
+// and forwarding headers ("1.2.3.4", "1.2.3.4:80", "[::1]:80", "::1").
+func parseIP(s string) netip.Addr {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap()
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+func isTrusted(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
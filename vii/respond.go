@@ -0,0 +1,364 @@
+package vii
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//=====================================
+// content negotiation
+//=====================================
+
+// Responder encodes data in a single media type. Respond buffers its output,
+// so a Responder can fail without a partial response being sent.
+type Responder func(w io.Writer, r *http.Request, data any) error
+
+type registeredResponder struct {
+	mediaType string
+	responder Responder
+}
+
+var (
+	respondersMu sync.RWMutex
+	// responders are listed in order of preference, used when the client
+	// rates several media types equally, e.g. with "*/*".
+	responders = []registeredResponder{
+		{"application/json", JSONResponder},
+		{"application/xml", XMLResponder},
+		{"text/plain", TextResponder},
+		{"text/xml", XMLResponder},
+	}
+)
+
+// RegisterResponder makes Respond able to answer with mediaType, such as
+// "text/csv" with CSVResponder or "application/x-ndjson" with
+// NDJSONResponder. A responder registered for an existing media type
+// replaces it; new media types are preferred after the existing ones.
+func RegisterResponder(mediaType string, responder Responder) {
+	mediaType = strings.ToLower(mediaType)
+	respondersMu.Lock()
+	defer respondersMu.Unlock()
+	for i, registered := range responders {
+		if registered.mediaType == mediaType {
+			responders[i].responder = responder
+			return
+		}
+	}
+	responders = append(responders, registeredResponder{mediaType, responder})
+}
+
+// ViewData pairs data with the HTML template that renders it. Create one
+// with View.
+type ViewData struct {
+	Template string
+	Data     any
+}
+
+// View wraps data so that Respond can also answer text/html by executing
+// the named template with data. Other formats encode data itself.
+func View(template string, data any) *ViewData {
+	return &ViewData{Template: template, Data: data}
+}
+
+// Respond writes data with status in the format the client prefers, going
+// by the q-values in its Accept header. JSON, XML and plain text are always
+// available, along with any media type added with RegisterResponder. When
+// data is a View, text/html is available too and preferred over the others
+// for clients that accept anything, such as htmx requests.
+//
+// Respond sets Vary: Accept. If no format is acceptable it writes nothing
+// and returns an HTTPError with status 406, which the app's error handler
+// turns into a response. Encoding errors are returned before anything is
+// written.
+func Respond(w http.ResponseWriter, r *http.Request, status int, data any) error {
+	addVary(w.Header(), "Accept")
+
+	view, isView := data.(*ViewData)
+	respondersMu.RLock()
+	offers := make([]registeredResponder, 0, len(responders)+1)
+	if isView {
+		offers = append(offers, registeredResponder{"text/html", htmlResponder})
+	}
+	offers = append(offers, responders...)
+	respondersMu.RUnlock()
+
+	offer, ok := negotiate(r.Header.Values("Accept"), offers)
+	if !ok {
+		types := make([]string, len(offers))
+		for i, o := range offers {
+			types[i] = o.mediaType
+		}
+		return NewHTTPError(http.StatusNotAcceptable, "Supported media types: "+strings.Join(types, ", "))
+	}
+
+	if isView && offer.mediaType != "text/html" {
+		data = view.Data
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := offer.responder(buf, r, data); err != nil {
+		var reloadErr *reloadError
+		if errors.As(err, &reloadErr) {
+			return writeReloadError(w, reloadErr.err)
+		}
+		return err
+	}
+
+	contentType := offer.mediaType
+	if strings.HasPrefix(contentType, "text/") {
+		contentType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if offer.mediaType == "text/html" {
+		markLiveReload(w)
+	}
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// JSONResponder encodes data as JSON.
+func JSONResponder(w io.Writer, r *http.Request, data any) error {
+	return json.NewEncoder(w).Encode(data)
+}
+
+// XMLResponder encodes data with encoding/xml, so data must be a type it
+// supports, such as a struct; maps are not.
+func XMLResponder(w io.Writer, r *http.Request, data any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(data)
+}
+
+// TextResponder writes strings, byte slices, errors and fmt.Stringers as
+// they are, and anything else formatted with %+v, followed by a newline.
+func TextResponder(w io.Writer, r *http.Request, data any) error {
+	var text string
+	switch v := data.(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	case error:
+		text = v.Error()
+	case fmt.Stringer:
+		text = v.String()
+	default:
+		text = fmt.Sprintf("%+v", data)
+	}
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	_, err := io.WriteString(w, text)
+	return err
+}
+
+// CSVResponder encodes a [][]string as rows, or a slice of structs with a
+// header row of field names taken from csv tags, then json tags, then the
+// Go field names. It is not registered by default:
+//
+//	vii.RegisterResponder("text/csv", vii.CSVResponder)
+func CSVResponder(w io.Writer, r *http.Request, data any) error {
+	cw := csv.NewWriter(w)
+	if rows, ok := data.([][]string); ok {
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+
+	v := reflect.ValueOf(data)
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("CSVResponder requires [][]string or a slice of structs, got %T", data)
+	}
+	elem := v.Type().Elem()
+	for elem.Kind() == reflect.Pointer {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		return fmt.Errorf("CSVResponder requires [][]string or a slice of structs, got %T", data)
+	}
+
+	var header []string
+	var fields []int
+	for i := 0; i < elem.NumField(); i++ {
+		sf := elem.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("csv"), ",")
+		if name == "-" || (name == "" && sf.Tag.Get("json") == "-") {
+			continue
+		}
+		if name == "" {
+			name = jsonFieldName(sf)
+		}
+		header = append(header, name)
+		fields = append(fields, i)
+	}
+	cw.Write(header)
+	row := make([]string, len(fields))
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		for item.Kind() == reflect.Pointer {
+			if item.IsNil() {
+				break
+			}
+			item = item.Elem()
+		}
+		if item.Kind() != reflect.Struct {
+			continue
+		}
+		for j, field := range fields {
+			row[j] = csvValue(item.Field(field))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvValue(v reflect.Value) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// NDJSONResponder writes each element of a slice or array as one line of
+// JSON, or any other value as a single line. It is not registered by
+// default:
+//
+//	vii.RegisterResponder("application/x-ndjson", vii.NDJSONResponder)
+func NDJSONResponder(w io.Writer, r *http.Request, data any) error {
+	enc := json.NewEncoder(w)
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return enc.Encode(data)
+	}
+	for i := 0; i < v.Len(); i++ {
+		if err := enc.Encode(v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// htmlResponder executes the template of a View, as Render would.
+func htmlResponder(w io.Writer, r *http.Request, data any) error {
+	view := data.(*ViewData)
+	return executeTemplate(w, r, view.Template, nil, view.Data)
+}
+
+// acceptRange is one media range from an Accept header.
+type acceptRange struct {
+	typ, subtype string
+	q            float64
+}
+
+func parseAccept(values []string) []acceptRange {
+	var ranges []acceptRange
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+			if !ok || typ == "" || subtype == "" {
+				continue
+			}
+			ar := acceptRange{typ: typ, subtype: subtype, q: 1}
+			for _, param := range params[1:] {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") {
+					q, err := strconv.ParseFloat(val, 64)
+					if err != nil || q < 0 || q > 1 {
+						q = 0
+					}
+					ar.q = q
+				}
+			}
+			ranges = append(ranges, ar)
+		}
+	}
+	return ranges
+}
+
+// negotiate picks the offer with the highest q-value, weighing each offer by
+// the most specific range that matches it. Ties go to the earlier offer. A
+// missing, empty or unparseable Accept header accepts the first offer.
+func negotiate(accept []string, offers []registeredResponder) (registeredResponder, bool) {
+	ranges := parseAccept(accept)
+	if len(ranges) == 0 {
+		return offers[0], len(offers) > 0
+	}
+
+	var best registeredResponder
+	bestQ := 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer.mediaType, "/")
+		q, specificity := 0.0, -1
+		for _, ar := range ranges {
+			s := -1
+			switch {
+			case ar.typ == typ && ar.subtype == subtype:
+				s = 2
+			case ar.typ == typ && ar.subtype == "*":
+				s = 1
+			case ar.typ == "*" && ar.subtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = ar.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best, bestQ > 0
+}
+
+// addVary adds field to the Vary header unless it is already listed.
+func addVary(h http.Header, field string) {
+	for _, value := range h.Values("Vary") {
+		for _, existing := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns buf to the pool unless it has grown unusually large.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > 64<<10 {
+		return
+	}
+	bufferPool.Put(buf)
+}
@@ -32,6 +32,7 @@ func SetCookie(w http.ResponseWriter, cookie *http.Cookie) {
 // WriteHTML writes a raw HTML string as the response.
 func WriteHTML(w http.ResponseWriter, status int, content string) {
 	w.Header().Set("Content-Type", "text/html")
+	markLiveReload(w)
 	w.WriteHeader(status)
 	w.Write([]byte(content))
 }
@@ -0,0 +1,258 @@
+package vii
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+//=====================================
+// routes
+//=====================================
+
+// Route describes a handler registered on the app, including static file
+// routes added by Favicon, ServeDir and ServeFS.
+type Route struct {
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	Prefix     string   `json:"prefix,omitempty"`
+	Name       string   `json:"name,omitempty"`
+	Middleware []string `json:"middleware"`
+	Source     string   `json:"source,omitempty"`
+	app        *App
+	group      *Group
+	middleware []func(http.Handler) http.Handler
+	typed      *TypedHandler // request and response types for OpenAPI
+	query      []string      // query parameters documented by WithURL
+	hidden     bool          // left out of the OpenAPI document
+	layout     *string       // set by Layout
+}
+
+// Named gives the route a name so URLs for it can be generated with
+// App.URLFor or the urlFor template function. Names must be unique.
+func (rt *Route) Named(name string) *Route {
+	if _, exists := rt.app.namedRoutes[name]; exists {
+		panic(fmt.Sprintf("vii: route name %q is already registered", name))
+	}
+	rt.Name = name
+	rt.app.namedRoutes[name] = rt
+	return rt
+}
+
+// URL returns a URL definition for the route's path and any query
+// parameters recorded with WithURL.
+func (rt *Route) URL() *URL {
+	return NewURL(rt.Path).WithQuery(rt.query...)
+}
+
+// Layout sets the layout Render uses for pages rendered by this route,
+// overriding TemplateConfig.DefaultLayout. An empty name renders pages
+// without a layout.
+func (rt *Route) Layout(name string) *Route {
+	rt.layout = &name
+	return rt
+}
+
+// withLayout records the route's layout, if any, on the request.
+func (rt *Route) withLayout(r *http.Request) *http.Request {
+	if rt.layout == nil {
+		return r
+	}
+	return SetContext(layoutContextKey, *rt.layout, r)
+}
+
+// WithURL records the query parameters of a URL definition on the route, so
+// they appear in the OpenAPI document:
+//
+//	search := vii.NewURL("/search").WithQuery("q", "page")
+//	app.Handle(search.Pattern("GET"), handler).WithURL(search)
+func (rt *Route) WithURL(u *URL) *Route {
+	for _, param := range u.QueryParams {
+		if !slices.Contains(rt.query, param) {
+			rt.query = append(rt.query, param)
+		}
+	}
+	return rt
+}
+
+// addRoute records a registered ServeMux pattern on the app along with the
+// group (nil for app-level routes) and local middleware it was registered with.
+func (app *App) addRoute(pattern string, group *Group, middleware []func(http.Handler) http.Handler) *Route {
+	method, path := splitPattern(pattern)
+	rt := &Route{
+		Method:     method,
+		Path:       path,
+		Source:     callerSource(),
+		app:        app,
+		group:      group,
+		middleware: middleware,
+	}
+	if group != nil {
+		rt.Prefix = group.prefix
+	}
+	app.routes = append(app.routes, rt)
+	return rt
+}
+
+// Routes returns a snapshot of every registered route in registration order.
+// Middleware lists global middleware first, then group middleware from the
+// outermost group inwards, then the route's own.
+func (app *App) Routes() []Route {
+	routes := make([]Route, 0, len(app.routes))
+	for _, rt := range app.routes {
+		route := *rt
+		route.Middleware = []string{}
+		for _, m := range app.GlobalMiddleware {
+			route.Middleware = append(route.Middleware, middlewareName(m))
+		}
+		var middleware []func(http.Handler) http.Handler
+		if rt.group != nil {
+			middleware = rt.group.allMiddleware()
+		}
+		for _, m := range append(middleware, rt.middleware...) {
+			route.Middleware = append(route.Middleware, middlewareName(m))
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// WriteRoutes prints routes as an aligned table, one route per line.
+func WriteRoutes(w io.Writer, routes []Route) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tPATH\tNAME\tMIDDLEWARE\tSOURCE")
+	for _, rt := range routes {
+		method := rt.Method
+		if method == "" {
+			method = "ANY"
+		}
+		middleware := strings.Join(rt.Middleware, ",")
+		if middleware == "" {
+			middleware = "-"
+		}
+		name := rt.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", method, rt.Path, name, middleware, rt.Source)
+	}
+	return tw.Flush()
+}
+
+// WriteRoutesJSON prints routes as an indented JSON array.
+func WriteRoutesJSON(w io.Writer, routes []Route) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(routes)
+}
+
+// URLFor builds the URL for a named route. Values matching the route's
+// wildcards fill the path; any others are added as query parameters.
+func (app *App) URLFor(name string, params Values) (string, error) {
+	rt, ok := app.namedRoutes[name]
+	if !ok {
+		return "", fmt.Errorf("no route named %q", name)
+	}
+	u := rt.URL()
+	for key := range params {
+		if !slices.Contains(u.PathParams, key) {
+			u.WithQuery(key)
+		}
+	}
+	return u.Resolve(params)
+}
+
+// urlFor is the template function form of URLFor. Parameters are passed as
+// alternating keys and values: {{ urlFor "user" "id" .ID }}.
+func (app *App) urlFor(name string, pairs ...any) (string, error) {
+	if len(pairs)%2 != 0 {
+		return "", fmt.Errorf("urlFor %q: parameters must be key/value pairs", name)
+	}
+	params := make(Values, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return "", fmt.Errorf("urlFor %q: parameter key %v is not a string", name, pairs[i])
+		}
+		params[key] = fmt.Sprint(pairs[i+1])
+	}
+	return app.URLFor(name, params)
+}
+
+// splitPattern separates the method from a ServeMux pattern and strips any
+// host, returning the method (possibly empty) and the path.
+func splitPattern(pattern string) (method string, path string) {
+	path = pattern
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		method = pattern[:i]
+		path = strings.TrimLeft(pattern[i:], " \t")
+	}
+	if i := strings.Index(path, "/"); i > 0 {
+		path = path[i:]
+	}
+	return method, path
+}
+
+// middlewareName returns a short, readable name for a middleware function,
+// such as "vii.Logger", or "vii.Timeout" for the closure Timeout returns.
+func middlewareName(m func(http.Handler) http.Handler) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(m).Pointer())
+	if fn == nil {
+		return "unknown"
+	}
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	// Strip closure suffixes like ".func1" or ".func2.1".
+	for {
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		suffix := name[i+1:]
+		if !strings.HasPrefix(suffix, "func") && strings.Trim(suffix, "0123456789") != "" {
+			break
+		}
+		name = name[:i]
+	}
+	// Closures returned by FooWithConfig are reported as Foo.
+	return strings.TrimSuffix(name, "WithConfig")
+}
+
+// packageDir is the directory holding vii's own source files. It is used to
+// skip frames inside the framework when looking for a route's caller.
+var packageDir = func() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Dir(file)
+}()
+
+// callerSource returns the file:line of the first caller outside vii.
+func callerSource() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if filepath.Dir(frame.File) != packageDir || strings.HasSuffix(frame.File, "_test.go") {
+			file := frame.File
+			if wd, err := os.Getwd(); err == nil {
+				if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+					file = rel
+				}
+			}
+			return fmt.Sprintf("%s:%d", file, frame.Line)
+		}
+		if !more {
+			return ""
+		}
+	}
+}
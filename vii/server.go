@@ -0,0 +1,157 @@
+package vii
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//=====================================
+// server
+//=====================================
+
+// ServerConfig configures the http.Server started by ServeWithConfig.
+// Zero durations leave the corresponding timeout disabled, except
+// ReadHeaderTimeout and IdleTimeout which default to 10s and 120s.
+type ServerConfig struct {
+	Addr              string // Bind address, e.g. ":8080" or "127.0.0.1:8080".
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	TLSCertFile       string // Serve HTTPS when both cert and key are set.
+	TLSKeyFile        string
+	ShutdownTimeout   time.Duration // How long ServeWithSignals waits for requests to drain. Defaults to 10s.
+}
+
+// OnStart registers a hook that runs once the listener is bound and before
+// requests are served. Hooks run in registration order; an error stops the
+// server from starting.
+func (app *App) OnStart(hook func() error) {
+	app.startHooks = append(app.startHooks, hook)
+}
+
+// OnShutdown registers a hook that runs after in-flight requests have been
+// drained by Shutdown. Hooks run in registration order.
+func (app *App) OnShutdown(hook func(ctx context.Context) error) {
+	app.shutdownHooks = append(app.shutdownHooks, hook)
+}
+
+// ServeWithConfig starts the server described by config and blocks until it
+// stops. It returns nil when the server was stopped with Shutdown, including
+// a Shutdown that came before it started serving.
+func (app *App) ServeWithConfig(config ServerConfig) error {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return errors.New("vii: TLSCertFile and TLSKeyFile must be set together")
+	}
+	if config.ReadHeaderTimeout <= 0 {
+		config.ReadHeaderTimeout = 10 * time.Second
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = 120 * time.Second
+	}
+
+	app.globalChain = Chain(app.Mux.ServeHTTP, app.GlobalMiddleware...)
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           app,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+
+	// The server is recorded before binding so a Shutdown during start-up
+	// is not lost: Serve returns at once on a server that was shut down.
+	app.serverMu.Lock()
+	if app.stopping {
+		app.serverMu.Unlock()
+		return nil
+	}
+	app.server = server
+	app.serverMu.Unlock()
+
+	ln, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return err
+	}
+	app.serverMu.Lock()
+	app.listener = ln
+	app.serverMu.Unlock()
+	for _, hook := range app.startHooks {
+		if err := hook(); err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	fmt.Println("starting server on " + ln.Addr().String() + " 🚀")
+	if config.TLSCertFile != "" && config.TLSKeyFile != "" {
+		err = server.ServeTLS(ln, config.TLSCertFile, config.TLSKeyFile)
+	} else {
+		err = server.Serve(ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests to
+// finish or ctx to expire, and then runs the OnShutdown hooks.
+func (app *App) Shutdown(ctx context.Context) error {
+	app.serverMu.Lock()
+	server, ln := app.server, app.listener
+	app.stopping = true
+	app.serverMu.Unlock()
+
+	var errs []error
+	if server != nil {
+		errs = append(errs, server.Shutdown(ctx))
+	}
+	if ln != nil {
+		// Serve closes the listener itself, but may not have started yet
+		// if the OnStart hooks are still running.
+		ln.Close()
+	}
+	for _, hook := range app.shutdownHooks {
+		errs = append(errs, hook(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// ServeWithSignals runs ServeWithConfig and shuts the server down gracefully
+// when the process receives SIGINT or SIGTERM.
+func (app *App) ServeWithSignals(config ServerConfig) error {
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 10 * time.Second
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- app.ServeWithConfig(config)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("shutting down server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	shutdownErr := app.Shutdown(shutdownCtx)
+	return errors.Join(<-serveErr, shutdownErr)
+}
@@ -0,0 +1,419 @@
+package vii
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//=====================================
+// server-sent events
+//=====================================
+
+// Event is a single server-sent event. Data that is a string or []byte is
+// sent as is, split over several data lines if it contains newlines; any
+// other value is encoded as JSON. Empty fields are omitted.
+type Event struct {
+	ID    string
+	Event string
+	Data  any
+	Retry time.Duration
+}
+
+// SSEConfig holds the configuration for SSEWithConfig.
+type SSEConfig struct {
+	// Heartbeat is the interval of comment lines sent to keep idle
+	// connections open through proxies. Defaults to 15s; negative disables.
+	Heartbeat time.Duration
+	// Retry, if set, is sent first to tell the browser how long to wait
+	// before reconnecting.
+	Retry time.Duration
+}
+
+// SSEStream writes server-sent events to one client. It is safe for
+// concurrent use.
+type SSEStream struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	ctx  context.Context
+	mu   sync.Mutex
+	err  error
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// ErrStreamClosed is returned by SSEStream.Send after Close.
+var ErrStreamClosed = errors.New("vii: event stream closed")
+
+// SSE starts an event stream with the default SSEConfig.
+func SSE(w http.ResponseWriter, r *http.Request) (*SSEStream, error) {
+	return SSEWithConfig(w, r, SSEConfig{})
+}
+
+// SSEWithConfig starts a text/event-stream response and flushes the headers.
+// It fails with http.ErrNotSupported, before writing anything, if the
+// writer cannot flush. The server's write timeout is lifted
+// for the response, and inside the Timeout middleware the response switches
+// to streaming. Call Close, usually deferred, before the handler returns:
+//
+//	stream, err := vii.SSE(w, r)
+//	if err != nil {
+//		return err
+//	}
+//	defer stream.Close()
+//	for {
+//		select {
+//		case <-stream.Done():
+//			return nil
+//		case msg := <-updates:
+//			stream.Send(vii.Event{Event: "update", Data: msg})
+//		}
+//	}
+func SSEWithConfig(w http.ResponseWriter, r *http.Request, config SSEConfig) (*SSEStream, error) {
+	if config.Heartbeat == 0 {
+		config.Heartbeat = 15 * time.Second
+	}
+	// Check before writing anything, so the caller can still send an error.
+	if !canFlush(w) {
+		return nil, fmt.Errorf("vii: response does not support streaming: %w", http.ErrNotSupported)
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+
+	s := &SSEStream{
+		w:    w,
+		rc:   http.NewResponseController(w),
+		ctx:  r.Context(),
+		stop: make(chan struct{}),
+	}
+	if err := s.rc.Flush(); err != nil {
+		return nil, fmt.Errorf("vii: response does not support streaming: %w", err)
+	}
+	// Long-lived streams would otherwise be cut off by the server's
+	// WriteTimeout. Not every writer supports deadlines, which is fine.
+	s.rc.SetWriteDeadline(time.Time{})
+
+	if config.Retry > 0 {
+		if err := s.Send(Event{Retry: config.Retry}); err != nil {
+			return nil, err
+		}
+	}
+	if config.Heartbeat > 0 {
+		s.wg.Add(1)
+		go s.heartbeat(config.Heartbeat)
+	}
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID header a reconnecting browser sends,
+// so the handler can resume from the event after it.
+func LastEventID(r *http.Request) string {
+	return r.Header.Get("Last-Event-ID")
+}
+
+// Done is closed when the client disconnects or the request ends.
+func (s *SSEStream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Send writes and flushes an event. It returns an error once the client has
+// gone or the stream is closed, after which the handler should return.
+func (s *SSEStream) Send(e Event) error {
+	var b strings.Builder
+	if e.ID != "" {
+		b.WriteString("id: " + sseLine(e.ID) + "\n")
+	}
+	if e.Event != "" {
+		b.WriteString("event: " + sseLine(e.Event) + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	if e.Data != nil {
+		var data string
+		switch v := e.Data.(type) {
+		case string:
+			data = v
+		case []byte:
+			data = string(v)
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			data = string(encoded)
+		}
+		data = strings.ReplaceAll(data, "\r\n", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *SSEStream) Comment(text string) error {
+	return s.write(": " + sseLine(text) + "\n\n")
+}
+
+// Close stops the heartbeat. Later sends fail with ErrStreamClosed.
+func (s *SSEStream) Close() error {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = ErrStreamClosed
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *SSEStream) write(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := s.w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *SSEStream) heartbeat(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.write(": ping\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// sseLine strips line breaks, which would end a field early.
+func sseLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+//=====================================
+// broker
+//=====================================
+
+// BrokerConfig holds the configuration for NewBroker.
+type BrokerConfig struct {
+	// BufferSize is the number of events queued per subscriber. A subscriber
+	// that falls further behind is disconnected, and can resume from its
+	// last event by reconnecting. Defaults to 16.
+	BufferSize int
+	// HistorySize is the number of recent events kept for Last-Event-ID
+	// resume. Defaults to 100; negative disables history.
+	HistorySize int
+}
+
+// Broker fans events out to subscribers by topic. Events published without
+// an ID are numbered, so clients can resume from where they left off.
+type Broker struct {
+	mu          sync.Mutex
+	config      BrokerConfig
+	seq         uint64
+	history     []brokerEvent
+	subscribers map[string]map[*Subscription]struct{}
+}
+
+type brokerEvent struct {
+	topic string
+	event Event
+}
+
+// Subscription receives the events of one or more topics.
+type Subscription struct {
+	broker *Broker
+	topics []string
+	events chan Event
+	closed bool
+}
+
+// NewBroker returns an empty Broker.
+func NewBroker(config BrokerConfig) *Broker {
+	if config.BufferSize <= 0 {
+		config.BufferSize = 16
+	}
+	if config.HistorySize == 0 {
+		config.HistorySize = 100
+	}
+	return &Broker{
+		config:      config,
+		subscribers: make(map[string]map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends an event to every subscriber of topic and returns how many
+// received it. Subscribers whose buffer is full are disconnected.
+func (b *Broker) Publish(topic string, e Event) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	if e.ID == "" {
+		e.ID = strconv.FormatUint(b.seq, 10)
+	}
+	if b.config.HistorySize > 0 {
+		if len(b.history) == b.config.HistorySize {
+			b.history = append(b.history[:0], b.history[1:]...)
+		}
+		b.history = append(b.history, brokerEvent{topic: topic, event: e})
+	}
+
+	delivered := 0
+	for sub := range b.subscribers[topic] {
+		select {
+		case sub.events <- e:
+			delivered++
+		default:
+			b.unsubscribeLocked(sub)
+		}
+	}
+	return delivered
+}
+
+// Subscribe registers for the given topics. If lastEventID names an event
+// still in the history, the events after it on those topics are queued
+// first. Close the subscription when done.
+func (b *Broker) Subscribe(lastEventID string, topics ...string) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var replay []Event
+	if lastEventID != "" {
+		found := false
+		for _, be := range b.history {
+			if found && slices.Contains(topics, be.topic) {
+				replay = append(replay, be.event)
+			}
+			if be.event.ID == lastEventID {
+				found = true
+			}
+		}
+		if !found {
+			replay = nil
+		}
+	}
+
+	sub := &Subscription{
+		broker: b,
+		topics: topics,
+		events: make(chan Event, b.config.BufferSize+len(replay)),
+	}
+	for _, e := range replay {
+		sub.events <- e
+	}
+	for _, topic := range topics {
+		if b.subscribers[topic] == nil {
+			b.subscribers[topic] = make(map[*Subscription]struct{})
+		}
+		b.subscribers[topic][sub] = struct{}{}
+	}
+	return sub
+}
+
+// Events returns the channel of events, which is closed when the
+// subscription is closed or disconnected for falling behind.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Close unsubscribes from all topics.
+func (sub *Subscription) Close() {
+	sub.broker.mu.Lock()
+	defer sub.broker.mu.Unlock()
+	sub.broker.unsubscribeLocked(sub)
+}
+
+func (b *Broker) unsubscribeLocked(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	for _, topic := range sub.topics {
+		delete(b.subscribers[topic], sub)
+		if len(b.subscribers[topic]) == 0 {
+			delete(b.subscribers, topic)
+		}
+	}
+	close(sub.events)
+}
+
+// ServeSSE streams the given topics to the client as server-sent events,
+// resuming after its Last-Event-ID, until the client disconnects or falls
+// too far behind. It can be used directly as a handler body:
+//
+//	app.HandleErr("GET /events", func(w http.ResponseWriter, r *http.Request) error {
+//		return broker.ServeSSE(w, r, "news")
+//	})
+func (b *Broker) ServeSSE(w http.ResponseWriter, r *http.Request, topics ...string) error {
+	stream, err := SSE(w, r)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	sub := b.Subscribe(LastEventID(r), topics...)
+	defer sub.Close()
+
+	for {
+		select {
+		case <-stream.Done():
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(e); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// canFlush reports whether the writer at the bottom of w's Unwrap chain can
+// flush. Wrappers such as Recover's and Logger's always have a Flush method,
+// so only the innermost writer tells whether flushing reaches the client.
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		inner := u.Unwrap()
+		if inner == nil {
+			break
+		}
+		w = inner
+	}
+	switch w.(type) {
+	case interface{ FlushError() error }, http.Flusher:
+		return true
+	}
+	return false
+}
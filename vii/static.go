@@ -3,6 +3,7 @@ package vii
 import (
 	"io/fs"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 )
@@ -15,6 +16,7 @@ func (app *App) Favicon(middleware ...func(http.Handler) http.Handler) {
 			http.ServeFile(w, r, fullPath)
 		}, middleware...).ServeHTTP(w, r)
 	})
+	app.addRoute("GET /favicon.ico", nil, middleware).hidden = true
 }
 
 // ServeDir serves files from disk at a specified URL prefix.
@@ -29,6 +31,8 @@ func (app *App) ServeDir(urlPrefix string, dirPath string, middleware ...func(ht
 		handler = Chain(stripHandler.ServeHTTP, middleware...)
 	}
 	app.Mux.Handle("GET "+urlPrefix, handler)
+	app.addRoute("GET "+urlPrefix, nil, middleware).hidden = true
+	app.watchFiles(os.DirFS(dirPath))
 }
 
 // ServeFS serves files from an embedded filesystem (NEW)
@@ -50,4 +54,5 @@ func (app *App) ServeFS(urlPrefix string, fileSystem fs.FS, middleware ...func(h
 	}
 
 	app.Mux.Handle("GET "+urlPrefix, handler)
+	app.addRoute("GET "+urlPrefix, nil, middleware).hidden = true
 }
@@ -1,12 +1,18 @@
 package vii
 
 import (
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 //=====================================
@@ -14,17 +20,37 @@ import (
 //=====================================
 
 // LoadTemplates loads templates from disk (Legacy)
+//
+// Templates are parsed once; use LoadTemplatesReload during development to
+// pick up edits without restarting.
 func (app *App) LoadTemplates(path string, funcMap template.FuncMap) error {
-	strEquals := func(input string, value string) bool {
-		return input == value
-	}
-	vbfFuncMap := template.FuncMap{
-		"strEquals": strEquals,
-	}
-	for k, v := range funcMap {
-		vbfFuncMap[k] = v
+	templates, err := parseTemplateDir(path, app.templateFuncs(funcMap))
+	if err != nil {
+		return err
 	}
-	templates := template.New("").Funcs(vbfFuncMap)
+	app.SetContext(VII_CONTEXT, templates)
+	app.watchFiles(os.DirFS(path))
+	return nil
+}
+
+// LoadTemplatesReload loads templates from disk like LoadTemplates, naming
+// them by base name, and re-parses them when files in the directory change,
+// as TemplateConfig.Reload does for LoadTemplatesWithConfig. A template that
+// fails to parse is shown as an error page in the browser until it is
+// fixed, and the error is not returned. It is meant for development.
+func (app *App) LoadTemplatesReload(path string, funcMap template.FuncMap) error {
+	funcs := app.templateFuncs(funcMap)
+	app.SetContext(VII_CONTEXT, newTemplateReloader(os.DirFS(path), 0, func() (any, error) {
+		return parseTemplateDir(path, funcs)
+	}))
+	app.watchFiles(os.DirFS(path))
+	return nil
+}
+
+// parseTemplateDir parses every .html file under path, naming each template
+// by its base name.
+func parseTemplateDir(path string, funcs template.FuncMap) (*template.Template, error) {
+	templates := template.New("").Funcs(funcs)
 	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -38,27 +64,18 @@ func (app *App) LoadTemplates(path string, funcMap template.FuncMap) error {
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	app.SetContext(VII_CONTEXT, templates)
-	return nil
+	return templates, nil
 }
 
 // LoadTemplatesFS loads templates from an embedded filesystem.
 // The fileSystem parameter is the embedded FS (e.g., templateFS from a //go:embed directive).
-// It will parse all *.html files in the filesystem.
+// It will parse all *.html files in the filesystem. Embedded files never
+// change, so there is nothing to reload; use LoadTemplatesReload for a
+// directory on disk.
 func (app *App) LoadTemplatesFS(fileSystem fs.FS, funcMap template.FuncMap) error {
-	strEquals := func(input string, value string) bool {
-		return input == value
-	}
-	vbfFuncMap := template.FuncMap{
-		"strEquals": strEquals,
-	}
-	for k, v := range funcMap {
-		vbfFuncMap[k] = v
-	}
-
-	templates := template.New("").Funcs(vbfFuncMap)
+	templates := template.New("").Funcs(app.templateFuncs(funcMap))
 
 	var paths []string
 	err := fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
@@ -82,20 +99,290 @@ func (app *App) LoadTemplatesFS(fileSystem fs.FS, funcMap template.FuncMap) erro
 	}
 
 	app.SetContext(VII_CONTEXT, templates)
+	app.watchFiles(fileSystem)
 	return nil
 }
 
-func getTemplates(r *http.Request) *template.Template {
-	templates, _ := GetContext(VII_CONTEXT, r).(*template.Template)
-	return templates
+// templateFuncs returns the built-in template functions merged with the
+// caller's funcMap. Entries in funcMap take precedence.
+func (app *App) templateFuncs(funcMap template.FuncMap) template.FuncMap {
+	strEquals := func(input string, value string) bool {
+		return input == value
+	}
+	vbfFuncMap := template.FuncMap{
+		"strEquals": strEquals,
+		"urlFor":    app.urlFor,
+	}
+	for k, v := range funcMap {
+		vbfFuncMap[k] = v
+	}
+	return vbfFuncMap
+}
+
+// layoutContextKey holds the layout chosen for a route with Route.Layout.
+const layoutContextKey = "VII_LAYOUT"
+
+// TemplateConfig holds the configuration for LoadTemplatesWithConfig.
+type TemplateConfig struct {
+	// LayoutDir holds layouts, which are shared by every page. Defaults to
+	// "layouts".
+	LayoutDir string
+	// PartialDir holds partials, which are shared by every page. Defaults to
+	// "partials".
+	PartialDir string
+	// DefaultLayout is the layout pages render in when the route and the
+	// Render call don't choose one, e.g. "layouts/base.html". Empty renders
+	// pages on their own.
+	DefaultLayout string
+	// Funcs is merged with the built-in template functions.
+	Funcs template.FuncMap
+	// Reload re-parses the templates when files in the filesystem change,
+	// for development with os.DirFS. A template that fails to parse is shown
+	// as an error page in the browser until it is fixed, and the error is not
+	// returned by LoadTemplatesWithConfig. For templates loaded with
+	// LoadTemplates, use LoadTemplatesReload.
+	Reload bool
+	// ReloadInterval is the least time between checks for changed files.
+	// Defaults to 200ms.
+	ReloadInterval time.Duration
 }
 
-func Render(w http.ResponseWriter, r *http.Request, filepath string, data any) error {
-	w.Header().Add("Content-Type", "text/html")
-	templates := getTemplates(r)
-	err := templates.ExecuteTemplate(w, filepath, data)
+// TemplateSet holds the templates parsed by LoadTemplatesWithConfig. Every
+// page gets its own copy of the layouts and partials, so pages can define
+// the same blocks without overwriting each other.
+type TemplateSet struct {
+	shared        *template.Template
+	pages         map[string]*template.Template
+	defaultLayout string
+}
+
+// LoadTemplatesWithConfig loads every .html file in fileSystem, naming each
+// template by its slash-separated path, e.g. "pages/about.html". Files in
+// the layout and partial directories are shared; every other file is a
+// page, parsed into its own clone of the shared templates. A layout renders
+// the page's blocks with {{block "content" .}}{{end}}, and the page fills
+// them with {{define "content"}}...{{end}}. Use os.DirFS to load from disk.
+func (app *App) LoadTemplatesWithConfig(fileSystem fs.FS, config TemplateConfig) error {
+	if config.Reload {
+		funcs := app.templateFuncs(config.Funcs)
+		app.SetContext(VII_CONTEXT, newTemplateReloader(fileSystem, config.ReloadInterval, func() (any, error) {
+			return parseTemplateSet(fileSystem, config, funcs)
+		}))
+		app.watchFiles(fileSystem)
+		return nil
+	}
+	set, err := parseTemplateSet(fileSystem, config, app.templateFuncs(config.Funcs))
 	if err != nil {
 		return err
 	}
+	app.SetContext(VII_CONTEXT, set)
+	app.watchFiles(fileSystem)
 	return nil
 }
+
+func parseTemplateSet(fileSystem fs.FS, config TemplateConfig, funcs template.FuncMap) (*TemplateSet, error) {
+	if config.LayoutDir == "" {
+		config.LayoutDir = "layouts"
+	}
+	if config.PartialDir == "" {
+		config.PartialDir = "partials"
+	}
+	sharedDirs := []string{
+		strings.Trim(config.LayoutDir, "/") + "/",
+		strings.Trim(config.PartialDir, "/") + "/",
+	}
+
+	var shared, pages []string
+	err := fs.WalkDir(fileSystem, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".html") {
+			return nil
+		}
+		if strings.HasPrefix(path, sharedDirs[0]) || strings.HasPrefix(path, sharedDirs[1]) {
+			shared = append(shared, path)
+		} else {
+			pages = append(pages, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	set := &TemplateSet{
+		shared:        template.New("").Funcs(funcs),
+		pages:         make(map[string]*template.Template, len(pages)),
+		defaultLayout: config.DefaultLayout,
+	}
+	for _, path := range shared {
+		if err := parseTemplateFile(set.shared, fileSystem, path); err != nil {
+			return nil, err
+		}
+	}
+	if config.DefaultLayout != "" && set.shared.Lookup(config.DefaultLayout) == nil {
+		return nil, fmt.Errorf("vii: default layout %q not found", config.DefaultLayout)
+	}
+	for _, path := range pages {
+		page, err := set.shared.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if err := parseTemplateFile(page, fileSystem, path); err != nil {
+			return nil, err
+		}
+		set.pages[path] = page
+	}
+	return set, nil
+}
+
+// parseTemplateFile parses a file into t as a template named by its path.
+func parseTemplateFile(t *template.Template, fileSystem fs.FS, path string) error {
+	content, err := fs.ReadFile(fileSystem, path)
+	if err != nil {
+		return err
+	}
+	_, err = t.New(path).Parse(string(content))
+	return err
+}
+
+// execute renders a page inside layout, or on its own if layout is empty.
+// The layout can be any template the page sees, including one of its own
+// blocks, which renders just that fragment. Layouts and partials can also
+// be rendered directly by name.
+func (set *TemplateSet) execute(w io.Writer, name, layout string, data any) error {
+	page, ok := set.pages[name]
+	if !ok {
+		if set.shared.Lookup(name) != nil {
+			return set.shared.ExecuteTemplate(w, name, data)
+		}
+		return fmt.Errorf("vii: template %q not found", name)
+	}
+	if layout == "" {
+		return page.ExecuteTemplate(w, name, data)
+	}
+	if page.Lookup(layout) == nil {
+		return fmt.Errorf("vii: template %q not found for page %q", layout, name)
+	}
+	return page.ExecuteTemplate(w, layout, data)
+}
+
+// executeTemplate renders the named template from the templates loaded on
+// the app. A non-nil layout overrides the route's and the default layout.
+// Templates loaded with LoadTemplates have no layouts, so there a non-empty
+// layout is simply executed instead of name.
+func executeTemplate(w io.Writer, r *http.Request, name string, layout *string, data any) error {
+	loaded := GetContext(VII_CONTEXT, r)
+	if rl, ok := loaded.(*templateReloader); ok {
+		var err error
+		if loaded, err = rl.templates(); err != nil {
+			return &reloadError{err}
+		}
+	}
+	switch templates := loaded.(type) {
+	case *TemplateSet:
+		return newTemplateError(name, templates.execute(w, name, chooseLayout(r, templates, layout), data))
+	case *template.Template:
+		if layout != nil && *layout != "" {
+			name = *layout
+		}
+		return newTemplateError(name, templates.ExecuteTemplate(w, name, data))
+	default:
+		return ErrNoTemplates
+	}
+}
+
+// ErrNoTemplates is returned when rendering before templates were loaded.
+var ErrNoTemplates = errors.New("vii: no templates loaded")
+
+// TemplateError reports a template that failed to render.
+type TemplateError struct {
+	Name string // Template that failed, which may be a layout or partial of the page rendered.
+	Line int    // Line in that template, or 0 if unknown.
+	Err  error
+}
+
+func (e *TemplateError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("vii: template %s:%d: %v", e.Name, e.Line, e.Err)
+	}
+	return fmt.Sprintf("vii: template %s: %v", e.Name, e.Err)
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// templateLocation matches the "template: name:line" prefix of errors from
+// text/template, and the "html/template:name:line" prefix of escaping errors.
+var templateLocation = regexp.MustCompile(`template: ?([^:]+):(\d+)`)
+
+// newTemplateError wraps a failure to render name, taking the template and
+// line at fault from the error message when it has them.
+func newTemplateError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	te := &TemplateError{Name: name, Err: err}
+	if m := templateLocation.FindStringSubmatch(err.Error()); m != nil {
+		te.Name = m[1]
+		te.Line, _ = strconv.Atoi(m[2])
+	}
+	return te
+}
+
+// chooseLayout picks the layout for a page: the one given to the render
+// call, else the route's, else the set's default.
+func chooseLayout(r *http.Request, set *TemplateSet, layout *string) string {
+	if layout != nil {
+		return *layout
+	}
+	if routeLayout, ok := GetContext(layoutContextKey, r).(string); ok {
+		return routeLayout
+	}
+	return set.defaultLayout
+}
+
+// Render executes a loaded template with status 200. With
+// LoadTemplatesWithConfig, name is the page path, e.g. "pages/about.html",
+// and the page renders inside the layout set with Route.Layout, or else
+// TemplateConfig.DefaultLayout. With LoadTemplates and LoadTemplatesFS, name
+// is the file's base name.
+func Render(w http.ResponseWriter, r *http.Request, name string, data any) error {
+	return renderStatus(w, r, http.StatusOK, name, nil, data)
+}
+
+// RenderStatus executes a loaded template into a buffer and, if it succeeds,
+// writes it with status, Content-Type and Content-Length. If it fails
+// nothing is written, so the handler can still send an error response; the
+// error is a *TemplateError naming the template and line that failed, or
+// ErrNoTemplates.
+func RenderStatus(w http.ResponseWriter, r *http.Request, status int, name string, data any) error {
+	return renderStatus(w, r, status, name, nil, data)
+}
+
+// RenderLayout is like Render but renders the page inside the given layout,
+// or on its own if layout is empty.
+func RenderLayout(w http.ResponseWriter, r *http.Request, layout, name string, data any) error {
+	return renderStatus(w, r, http.StatusOK, name, &layout, data)
+}
+
+func renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, layout *string, data any) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := executeTemplate(buf, r, name, layout, data); err != nil {
+		var reloadErr *reloadError
+		if errors.As(err, &reloadErr) {
+			return writeReloadError(w, reloadErr.err)
+		}
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	markLiveReload(w)
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,309 @@
+package vii
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TimeoutConfig holds the configuration for TimeoutWithConfig.
+type TimeoutConfig struct {
+	Duration time.Duration // Defaults to 30s.
+	// Message is the body of the 503 response. Defaults to "Request timed out".
+	Message string
+	// ErrorResponder writes the 503 response. Defaults to PlainError; use
+	// ProblemError for application/problem+json.
+	ErrorResponder ErrorResponder
+}
+
+// Timeout is a middleware that answers with 503 if the handler takes longer
+// than the given number of seconds.
+func Timeout(seconds int) func(http.Handler) http.Handler {
+	return TimeoutWithConfig(TimeoutConfig{Duration: time.Duration(seconds) * time.Second})
+}
+
+// TimeoutWithConfig works like http.TimeoutHandler: the handler runs with a
+// context deadline and its response is buffered, so that a 503 can still be
+// sent when the deadline passes. After that, writes by the handler fail with
+// http.ErrHandlerTimeout.
+//
+// A handler that flushes before the deadline, such as an SSE stream, switches
+// the response to streaming: buffered output is sent, later writes go
+// straight to the client, and the deadline is lifted, so the stream lasts
+// until the handler returns or the client disconnects. Hijacking the
+// connection, as a WebSocket upgrade does, lifts the deadline the same way.
+//
+// Until then nothing reaches the client: output is not sent progressively,
+// 1xx responses such as 103 Early Hints are taken as the final status, and
+// once the deadline has passed Flush and Hijack fail with
+// http.ErrHandlerTimeout. Other http.ResponseController features, such as
+// SetWriteDeadline and EnableFullDuplex, reach the underlying writer.
+func TimeoutWithConfig(config TimeoutConfig) func(http.Handler) http.Handler {
+	if config.Duration <= 0 {
+		config.Duration = 30 * time.Second
+	}
+	if config.Message == "" {
+		config.Message = "Request timed out"
+	}
+	if config.ErrorResponder == nil {
+		config.ErrorResponder = PlainError
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := newTimeoutContext(r.Context(), config.Duration)
+			defer ctx.release()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{w: w, ctx: ctx, header: make(http.Header)}
+			done := make(chan struct{})
+			panicChan := make(chan any, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicChan <- p
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case p := <-panicChan:
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				if tw.streaming {
+					return
+				}
+				tw.sendLocked()
+			case <-ctx.Done():
+				tw.mu.Lock()
+				if tw.streaming {
+					// Only a disconnect ends a streaming response early; the
+					// handler still owns the writer until it returns.
+					tw.mu.Unlock()
+					select {
+					case p := <-panicChan:
+						panic(p)
+					case <-done:
+					}
+					return
+				}
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					config.ErrorResponder(w, r, http.StatusServiceUnavailable, config.Message)
+					return
+				}
+				// The client went away; there is nobody left to answer.
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// timeoutWriter buffers a handler's response until it completes in time,
+// or until it flushes and the response becomes a stream.
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	ctx         *timeoutContext
+	mu          sync.Mutex
+	header      http.Header
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	timedOut    bool
+	streaming   bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	if tw.streaming {
+		return tw.w.Write(p)
+	}
+	return tw.buf.Write(p)
+}
+
+// Flush sends the buffered response and switches to streaming, unless the
+// deadline has already passed.
+func (tw *timeoutWriter) Flush() {
+	tw.FlushError()
+}
+
+func (tw *timeoutWriter) FlushError() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return http.ErrHandlerTimeout
+	}
+	if !tw.streaming {
+		if !tw.ctx.lift() {
+			return http.ErrHandlerTimeout
+		}
+		if !tw.wroteHeader {
+			tw.writeHeaderLocked(http.StatusOK)
+		}
+		tw.sendLocked()
+		tw.streaming = true
+	}
+	return http.NewResponseController(tw.w).Flush()
+}
+
+// Hijack takes over the connection and lifts the deadline, unless it has
+// already passed. A response that has started buffering cannot be hijacked.
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	if !tw.streaming {
+		if tw.wroteHeader {
+			return nil, nil, errors.New("vii: cannot hijack a buffered response")
+		}
+		if !tw.ctx.lift() {
+			return nil, nil, http.ErrHandlerTimeout
+		}
+		tw.streaming = true
+	}
+	return http.NewResponseController(tw.w).Hijack()
+}
+
+// Unwrap returns the underlying writer, so http.ResponseController can reach
+// features such as deadlines. Flush and Hijack are handled by timeoutWriter
+// itself, so they cannot bypass the buffer.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// sendLocked copies the buffered header and body to the client.
+func (tw *timeoutWriter) sendLocked() {
+	dst := tw.w.Header()
+	for k, vv := range tw.header {
+		dst[k] = vv
+	}
+	if !tw.wroteHeader {
+		tw.code = http.StatusOK
+	}
+	tw.w.WriteHeader(tw.code)
+	tw.w.Write(tw.buf.Bytes())
+	tw.buf.Reset()
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if code < 100 || code > 999 {
+		panic(fmt.Sprintf("vii: invalid WriteHeader code %v", code))
+	}
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	tw.code = code
+}
+
+// timeoutContext is a context with a deadline that can be lifted once a
+// response starts streaming. Err reports context.DeadlineExceeded when the
+// deadline passes, like context.WithTimeout.
+type timeoutContext struct {
+	parent     context.Context
+	deadline   time.Time
+	done       chan struct{}
+	timer      *time.Timer
+	stopParent func() bool
+	mu         sync.Mutex
+	err        error
+	lifted     bool
+}
+
+func newTimeoutContext(parent context.Context, d time.Duration) *timeoutContext {
+	c := &timeoutContext{
+		parent:   parent,
+		deadline: time.Now().Add(d),
+		done:     make(chan struct{}),
+	}
+	if pd, ok := parent.Deadline(); ok && pd.Before(c.deadline) {
+		c.deadline = pd
+	}
+	c.timer = time.AfterFunc(d, func() { c.cancel(context.DeadlineExceeded) })
+	c.stopParent = context.AfterFunc(parent, func() { c.cancel(parent.Err()) })
+	return c
+}
+
+func (c *timeoutContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lifted {
+		return c.parent.Deadline()
+	}
+	return c.deadline, true
+}
+
+func (c *timeoutContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *timeoutContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *timeoutContext) Value(key any) any {
+	return c.parent.Value(key)
+}
+
+func (c *timeoutContext) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+// lift removes the deadline, reporting false if it has already passed.
+func (c *timeoutContext) lift() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return false
+	}
+	c.lifted = true
+	c.timer.Stop()
+	return true
+}
+
+// release frees the timer and cancels the context once the handler is done.
+func (c *timeoutContext) release() {
+	c.timer.Stop()
+	c.stopParent()
+	c.cancel(context.Canceled)
+}
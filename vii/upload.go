@@ -0,0 +1,279 @@
+package vii
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//=====================================
+// uploads
+//=====================================
+
+// UploadOptions holds the limits and destination for Uploads.
+type UploadOptions struct {
+	// MaxTotalSize caps the whole request body. Defaults to 32 MiB.
+	MaxTotalSize int64
+	// MaxFileSize caps each file. Defaults to 10 MiB.
+	MaxFileSize int64
+	// MaxFiles caps the number of files. Defaults to 10.
+	MaxFiles int
+	// AllowedTypes lists the media types accepted, such as "image/png" or
+	// "image/*". Types are detected from the file content with
+	// http.DetectContentType; the client's Content-Type is ignored. Empty
+	// allows any type.
+	AllowedTypes []string
+	// Dir is where files are written when Writer is nil. Defaults to
+	// os.TempDir().
+	Dir string
+	// Writer, if set, is called for each file once its type is known and
+	// returns where to write it, instead of a temporary file. If the writer
+	// is also an io.Closer it is closed after the file is written. Errors
+	// from Writer, and from writing or closing what it returns, are wrapped
+	// in a *BodyError with status 500, unless they already are a *BodyError.
+	Writer func(file *UploadedFile) (io.Writer, error)
+}
+
+// UploadedFile describes a file received by Uploads.
+type UploadedFile struct {
+	Field       string // Form field name.
+	Filename    string // Base name sent by the client; don't trust it as a path.
+	Size        int64
+	ContentType string // Detected from the content, without parameters.
+	SHA256      string // Hex-encoded digest of the content.
+	// Path is the temporary file holding the content, or "" when
+	// UploadOptions.Writer was used. It is removed when the request ends;
+	// move it with os.Rename to keep it.
+	Path string
+}
+
+// Open opens the temporary file of the upload for reading.
+func (f *UploadedFile) Open() (*os.File, error) {
+	if f.Path == "" {
+		return nil, errors.New("vii: upload was not written to a temporary file")
+	}
+	return os.Open(f.Path)
+}
+
+// UploadResult holds the files and other form values of a multipart request.
+type UploadResult struct {
+	Files  []*UploadedFile
+	Values url.Values
+}
+
+// Uploads streams a multipart/form-data request body, enforcing the limits
+// in opts, and returns its files and form values. Files are hashed as they
+// are written, so nothing is held in memory beyond a small buffer.
+// Temporary files are removed when the request's context ends, which for
+// server requests is when the handler returns. Pass the ResponseWriter so a
+// body over opts.MaxTotalSize also closes the connection, as with
+// ReadJSONWith.
+//
+// Errors are *BodyError values with status 400 for malformed bodies, 413
+// for size and count limits, 415 for disallowed types or a request that is
+// not multipart, and 500 when a file cannot be stored, with the cause
+// available through Unwrap. Files written before an error are removed.
+func Uploads(r *http.Request, w http.ResponseWriter, opts UploadOptions) (*UploadResult, error) {
+	if opts.MaxTotalSize <= 0 {
+		opts.MaxTotalSize = 32 << 20
+	}
+	if opts.MaxFileSize <= 0 {
+		opts.MaxFileSize = 10 << 20
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 10
+	}
+	if opts.Dir == "" {
+		opts.Dir = os.TempDir()
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, opts.MaxTotalSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, &BodyError{Status: http.StatusUnsupportedMediaType, Msg: "Content-Type must be multipart/form-data", Err: err}
+	}
+
+	result := &UploadResult{Values: url.Values{}}
+	var tempFiles []string
+	removeTempFiles := func() {
+		for _, path := range tempFiles {
+			os.Remove(path)
+		}
+	}
+	fail := func(err error) (*UploadResult, error) {
+		removeTempFiles()
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(uploadReadError(err, "", "malformed multipart body"))
+		}
+		field := part.FormName()
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				return fail(uploadReadError(err, field, "malformed multipart body"))
+			}
+			result.Values.Add(field, string(value))
+			continue
+		}
+
+		if len(result.Files) == opts.MaxFiles {
+			return fail(&BodyError{Status: http.StatusRequestEntityTooLarge, Field: field, Msg: fmt.Sprintf("too many files (limit %d)", opts.MaxFiles)})
+		}
+		file, path, err := receiveFile(part, opts)
+		if path != "" {
+			tempFiles = append(tempFiles, path)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		result.Files = append(result.Files, file)
+	}
+
+	if len(tempFiles) > 0 {
+		context.AfterFunc(r.Context(), removeTempFiles)
+	}
+	return result, nil
+}
+
+// receiveFile sniffs, checks and writes one file part. It returns the path
+// of any temporary file it created, even on error, so it can be removed.
+func receiveFile(part *multipart.Part, opts UploadOptions) (*UploadedFile, string, error) {
+	file := &UploadedFile{Field: part.FormName(), Filename: filepath.Base(part.FileName())}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, "", uploadReadError(err, file.Field, "malformed multipart body")
+	}
+	head = head[:n]
+	file.ContentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	if !uploadTypeAllowed(file.ContentType, opts.AllowedTypes) {
+		return nil, "", &BodyError{Status: http.StatusUnsupportedMediaType, Field: file.Field, Msg: fmt.Sprintf("file type %s is not allowed", file.ContentType)}
+	}
+
+	var dst io.Writer
+	path := ""
+	if opts.Writer != nil {
+		dst, err = opts.Writer(file)
+		if err != nil {
+			return nil, "", uploadWriteError(err, file.Field)
+		}
+	} else {
+		f, err := os.CreateTemp(opts.Dir, "vii-upload-*"+safeExt(file.Filename))
+		if err != nil {
+			return nil, "", uploadWriteError(err, file.Field)
+		}
+		dst, path = f, f.Name()
+		file.Path = path
+	}
+
+	hash := sha256.New()
+	out := &uploadDest{w: dst}
+	written, err := io.CopyN(io.MultiWriter(out, hash), io.MultiReader(bytes.NewReader(head), part), opts.MaxFileSize+1)
+	if closer, ok := dst.(io.Closer); ok {
+		if closeErr := closer.Close(); closeErr != nil && out.err == nil {
+			out.err = closeErr
+		}
+	}
+	if out.err != nil {
+		return nil, path, uploadWriteError(out.err, file.Field)
+	}
+	if err != nil && err != io.EOF {
+		return nil, path, uploadReadError(err, file.Field, "malformed multipart body")
+	}
+	if written > opts.MaxFileSize {
+		return nil, path, &BodyError{Status: http.StatusRequestEntityTooLarge, Field: file.Field, Msg: fmt.Sprintf("file exceeds %d bytes", opts.MaxFileSize)}
+	}
+	file.Size = written
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return file, path, nil
+}
+
+// uploadReadError turns a body read error into a *BodyError, reporting an
+// exceeded MaxTotalSize as 413.
+func uploadReadError(err error, field, msg string) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return &BodyError{Status: http.StatusRequestEntityTooLarge, Field: field, Msg: fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit), Err: err}
+	}
+	var bodyErr *BodyError
+	if errors.As(err, &bodyErr) {
+		return err
+	}
+	return &BodyError{Status: http.StatusBadRequest, Field: field, Msg: msg, Err: err}
+}
+
+// uploadDest records write errors from an upload's destination, so they are
+// not mistaken for a malformed request body.
+type uploadDest struct {
+	w   io.Writer
+	err error
+}
+
+func (d *uploadDest) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// uploadWriteError reports a file that could not be stored as a 500, without
+// the cause in the message shown to clients.
+func uploadWriteError(err error, field string) error {
+	var bodyErr *BodyError
+	if errors.As(err, &bodyErr) {
+		return err
+	}
+	return &BodyError{Status: http.StatusInternalServerError, Field: field, Msg: "could not store uploaded file", Err: err}
+}
+
+func uploadTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == contentType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(a, "/*"); ok && strings.HasPrefix(contentType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// safeExt returns the extension of name if it is short and plain, so temp
+// files keep a recognisable suffix without trusting arbitrary input.
+func safeExt(name string) string {
+	ext := filepath.Ext(name)
+	if len(ext) > 10 {
+		return ""
+	}
+	for _, c := range ext[min(1, len(ext)):] {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
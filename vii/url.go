@@ -1,24 +1,37 @@
 package vii
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
-// Values is a map of key-value pairs for building URL query strings.
+// Values is a map of key-value pairs for building URL path and query strings.
 type Values map[string]string
 
 // URL is a reusable primitive for defining, building, and parsing URLs.
+// The path may contain http.ServeMux wildcards such as "/users/{id}" or
+// "/files/{path...}", so the same definition can be registered as a route
+// and used to generate links to it.
 type URL struct {
 	Path        string
+	PathParams  []string
 	QueryParams []string
 }
 
-// NewURL creates a new URL definition with a static path.
+// NewURL creates a new URL definition from a path, recording any
+// ServeMux wildcards it contains as path parameters.
 func NewURL(path string) *URL {
-	return &URL{
+	u := &URL{
 		Path: path,
 	}
+	for _, segment := range strings.Split(path, "/") {
+		if name, _, ok := parseWildcard(segment); ok && name != "$" {
+			u.PathParams = append(u.PathParams, name)
+		}
+	}
+	return u
 }
 
 // WithQuery adds expected query parameter keys to the URL definition.
@@ -28,11 +41,38 @@ func (u *URL) WithQuery(params ...string) *URL {
 	return u
 }
 
-// Build constructs a URL string with the given query parameter values.
-// It correctly encodes the values for URL safety.
+// Pattern returns the ServeMux pattern for the URL, prefixed with the
+// method when one is given (e.g. "GET /users/{id}").
+func (u *URL) Pattern(method string) string {
+	if method == "" {
+		return u.Path
+	}
+	return method + " " + u.Path
+}
+
+// Build constructs a URL string with the given values, encoding them for URL
+// safety. A path parameter without a value keeps its wildcard, e.g.
+// "/users/{id}"; use Resolve to get an error instead.
 func (u *URL) Build(values Values) string {
+	built, _ := u.build(values, false)
+	return built
+}
+
+// Resolve constructs a URL string from the given values. Path parameters are
+// required and escaped segment by segment; query parameters are optional and
+// encoded for URL safety.
+func (u *URL) Resolve(values Values) (string, error) {
+	return u.build(values, true)
+}
+
+func (u *URL) build(values Values, strict bool) (string, error) {
+	path, err := u.buildPath(values, strict)
+	if err != nil {
+		return "", err
+	}
+
 	if len(u.QueryParams) == 0 || len(values) == 0 {
-		return u.Path
+		return path, nil
 	}
 
 	queryParams := url.Values{}
@@ -44,13 +84,48 @@ func (u *URL) Build(values Values) string {
 
 	queryString := queryParams.Encode()
 	if queryString == "" {
-		return u.Path
+		return path, nil
 	}
 
-	return u.Path + "?" + queryString
+	return path + "?" + queryString, nil
+}
+
+// buildPath fills the wildcards in the path with escaped values. Unless
+// strict, a wildcard without a value is left as it is.
+func (u *URL) buildPath(values Values, strict bool) (string, error) {
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		name, multi, ok := parseWildcard(segment)
+		if !ok {
+			continue
+		}
+		if name == "$" {
+			segments[i] = ""
+			continue
+		}
+		val, exists := values[name]
+		if !exists || (!multi && val == "") {
+			if !strict {
+				continue
+			}
+			return "", fmt.Errorf("missing value for path parameter %q in %q", name, u.Path)
+		}
+		if multi {
+			parts := strings.Split(val, "/")
+			for j, part := range parts {
+				parts[j] = url.PathEscape(part)
+			}
+			segments[i] = strings.Join(parts, "/")
+			continue
+		}
+		segments[i] = url.PathEscape(val)
+	}
+	return strings.Join(segments, "/"), nil
 }
 
-// Parse extracts the defined query parameters from an HTTP request's URL.
+// Parse extracts the defined path and query parameters from an HTTP request.
+// Path parameters are read with r.PathValue, so the request must have been
+// routed through a ServeMux pattern containing the same wildcards.
 // It returns a Values map containing the keys and their corresponding values.
 func (u *URL) Parse(r *http.Request) Values {
 	parsed := make(Values)
@@ -60,5 +135,22 @@ func (u *URL) Parse(r *http.Request) Values {
 		parsed[key] = requestQuery.Get(key)
 	}
 
+	for _, key := range u.PathParams {
+		parsed[key] = r.PathValue(key)
+	}
+
 	return parsed
 }
+
+// parseWildcard reports whether a path segment is a ServeMux wildcard,
+// returning its name and whether it matches the remainder of the path.
+func parseWildcard(segment string) (name string, multi bool, ok bool) {
+	if len(segment) < 3 || segment[0] != '{' || segment[len(segment)-1] != '}' {
+		return "", false, false
+	}
+	name = segment[1 : len(segment)-1]
+	if strings.HasSuffix(name, "...") {
+		return strings.TrimSuffix(name, "..."), true, true
+	}
+	return name, false, true
+}
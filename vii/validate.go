@@ -0,0 +1,444 @@
+package vii
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+//=====================================
+// validation
+//=====================================
+
+// ValidationRule checks a single value against a rule parameter (the part
+// after "=" in the tag, or "" if there is none). It returns an error whose
+// message is shown to clients, e.g. "must be at least 3 characters".
+// Pointers are dereferenced before rules run.
+type ValidationRule func(value reflect.Value, param string) error
+
+var (
+	validationMu    sync.RWMutex
+	validationRules = map[string]ValidationRule{
+		"required": validateRequired,
+		"min":      validateMin,
+		"max":      validateMax,
+		"len":      validateLen,
+		"email":    validateEmail,
+		"url":      validateURL,
+		"oneof":    validateOneOf,
+	}
+)
+
+// ruleParamCheckers check the parameters of built-in rules when a struct's
+// tags are parsed, so a malformed tag is reported before any value is.
+var ruleParamCheckers = map[string]func(param string) error{
+	"min":   checkNumberParam,
+	"max":   checkNumberParam,
+	"len":   checkNumberParam,
+	"oneof": checkOneOfParam,
+}
+
+// validationCache maps struct types to their parsed *structRules.
+var validationCache sync.Map
+
+// RegisterValidation adds a custom rule usable in validate tags, replacing
+// any rule with the same name. Register rules at startup, before the types
+// that use them are validated.
+func RegisterValidation(name string, rule ValidationRule) {
+	validationMu.Lock()
+	defer validationMu.Unlock()
+	validationRules[name] = rule
+	validationCache.Clear()
+}
+
+// ValidationErrors lists every field that failed validation.
+type ValidationErrors []FieldError
+
+func (ve ValidationErrors) Error() string {
+	msgs := make([]string, len(ve))
+	for i, f := range ve {
+		msgs[i] = f.Error()
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Map returns the first message for each field path, which is convenient
+// for showing errors next to inputs when re-rendering a form.
+func (ve ValidationErrors) Map() map[string]string {
+	m := make(map[string]string, len(ve))
+	for _, f := range ve {
+		if _, exists := m[f.Field]; !exists {
+			m[f.Field] = f.Message
+		}
+	}
+	return m
+}
+
+// Validate checks a struct against its validate tags:
+//
+//	type SignUp struct {
+//		Name  string   `json:"name" validate:"required,min=3,max=64"`
+//		Email string   `json:"email" validate:"required,email"`
+//		Plan  string   `json:"plan" validate:"oneof=free pro"`
+//		Items []Item   `json:"items" validate:"max=10"`
+//	}
+//
+// Nested structs and slices of structs are validated too. Field paths use
+// JSON names, e.g. "items[0].sku". Empty optional strings, slices, maps and
+// nil pointers skip their rules unless the field is required. Validate
+// returns ValidationErrors when any field fails.
+//
+// Tags are parsed once per type. An unknown rule or a malformed parameter,
+// such as "min=abc", is returned as a plain error rather than
+// ValidationErrors, since it is a bug in the struct and not in the input.
+// JSONHandler checks its request type up front with the same parser and
+// panics at registration instead.
+func Validate(v any) error {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return errors.New("Validate requires a non-nil struct")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("Validate requires a struct, got %T", v)
+	}
+
+	if err := structRulesFor(rv.Type()).err; err != nil {
+		return err
+	}
+	var errs ValidationErrors
+	validateStruct(rv, "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ReadAndValidateJSON decodes the request body with the ReadJSON rules and
+// then validates the result. It is shorthand for ReadJSONWith with
+// JSONOptions{Validate: true}, so an oversized body closes the connection.
+func ReadAndValidateJSON(r *http.Request, w http.ResponseWriter, v any) error {
+	return ReadJSONWith(r, w, v, JSONOptions{Validate: true})
+}
+
+// BindAndValidate binds the request with Bind and then validates the result.
+func BindAndValidate(r *http.Request, dst any) error {
+	if err := Bind(r, dst); err != nil {
+		return err
+	}
+	return Validate(dst)
+}
+
+// structRules holds the parsed validate tags of a struct type.
+type structRules struct {
+	fields []fieldRules
+	// err reports an unknown rule or malformed parameter in the struct or
+	// any struct nested in it.
+	err error
+}
+
+// fieldRules holds the parsed validate tag of one exported field.
+type fieldRules struct {
+	index    int
+	name     string // JSON name, or "" for embedded structs
+	rules    []parsedRule
+	required bool
+}
+
+type parsedRule struct {
+	name  string
+	param string
+	fn    ValidationRule
+}
+
+// structRulesFor returns the parsed rules of a struct type, parsing and
+// checking it and the structs nested in it on first use.
+func structRulesFor(t reflect.Type) *structRules {
+	if cached, ok := validationCache.Load(t); ok {
+		return cached.(*structRules)
+	}
+	sr := parseStructRules(t)
+	if sr.err == nil {
+		sr.err = checkNestedRules(t, map[reflect.Type]bool{t: true})
+	}
+	validationCache.Store(t, sr)
+	return sr
+}
+
+func parseStructRules(t reflect.Type) *structRules {
+	sr := &structRules{}
+	validationMu.RLock()
+	defer validationMu.RUnlock()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fr := fieldRules{index: i}
+		if !sf.Anonymous {
+			fr.name = jsonFieldName(sf)
+		}
+		if tag := sf.Tag.Get("validate"); tag != "" && tag != "-" {
+			for _, rule := range strings.Split(tag, ",") {
+				name, param, _ := strings.Cut(strings.TrimSpace(rule), "=")
+				if name == "" {
+					continue
+				}
+				fn, ok := validationRules[name]
+				if !ok {
+					sr.err = fmt.Errorf("vii: unknown validation rule %q on %s.%s", name, t, sf.Name)
+					return sr
+				}
+				if check := ruleParamCheckers[name]; check != nil {
+					if err := check(param); err != nil {
+						sr.err = fmt.Errorf("vii: invalid validation rule %q on %s.%s: %w", rule, t, sf.Name, err)
+						return sr
+					}
+				}
+				if name == "required" {
+					fr.required = true
+				}
+				fr.rules = append(fr.rules, parsedRule{name: name, param: param, fn: fn})
+			}
+		}
+		sr.fields = append(sr.fields, fr)
+	}
+	return sr
+}
+
+// checkNestedRules parses the structs reachable from t's fields, as
+// validateNested would visit them, and returns the first tag error.
+func checkNestedRules(t reflect.Type, seen map[reflect.Type]bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		ft := sf.Type
+		for ft.Kind() == reflect.Pointer || ft.Kind() == reflect.Slice || ft.Kind() == reflect.Array {
+			ft = ft.Elem()
+		}
+		if ft.Kind() != reflect.Struct || ft == timeType || seen[ft] {
+			continue
+		}
+		seen[ft] = true
+		if err := parseStructRules(ft).err; err != nil {
+			return err
+		}
+		if err := checkNestedRules(ft, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkValidation reports an unknown rule or malformed parameter in the
+// validate tags of t, a struct or pointer to one, or of structs nested in it.
+func checkValidation(t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return structRulesFor(t).err
+}
+
+func validateStruct(v reflect.Value, path string, errs *ValidationErrors) {
+	for _, fr := range structRulesFor(v.Type()).fields {
+		field := v.Field(fr.index)
+		fieldPath := path
+		if fr.name != "" {
+			fieldPath = joinFieldPath(path, fr.name)
+		}
+		if len(fr.rules) > 0 {
+			validateField(field, fieldPath, fr, errs)
+		}
+		validateNested(field, fieldPath, errs)
+	}
+}
+
+func validateField(field reflect.Value, path string, fr fieldRules, errs *ValidationErrors) {
+	if !fr.required && isEmptyOptional(field) {
+		return
+	}
+	value := field
+	for value.Kind() == reflect.Pointer && !value.IsNil() {
+		value = value.Elem()
+	}
+
+	for _, rule := range fr.rules {
+		// required checks the field itself, so a pointer to a zero value counts
+		// as present; every other rule sees the dereferenced value.
+		target := value
+		if rule.name == "required" {
+			target = field
+		}
+		if err := rule.fn(target, rule.param); err != nil {
+			*errs = append(*errs, FieldError{Field: path, Rule: rule.name, Param: rule.param, Message: err.Error()})
+			if rule.name == "required" {
+				return
+			}
+		}
+	}
+}
+
+// validateNested recurses into struct values and slices or arrays of them.
+func validateNested(v reflect.Value, path string, errs *ValidationErrors) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() != timeType {
+			validateStruct(v, path, errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateNested(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+func isEmptyOptional(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+func jsonFieldName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return sf.Name
+	}
+	return name
+}
+
+func joinFieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func validateRequired(v reflect.Value, _ string) error {
+	if !v.IsValid() || v.IsZero() || (isCollection(v) && v.Len() == 0) {
+		return errors.New("is required")
+	}
+	return nil
+}
+
+func validateMin(v reflect.Value, param string) error {
+	return compareSize(v, param, func(size, limit float64) bool { return size >= limit }, "at least")
+}
+
+func validateMax(v reflect.Value, param string) error {
+	return compareSize(v, param, func(size, limit float64) bool { return size <= limit }, "at most")
+}
+
+func validateLen(v reflect.Value, param string) error {
+	return compareSize(v, param, func(size, limit float64) bool { return size == limit }, "exactly")
+}
+
+// compareSize compares the length of strings and collections, or the value
+// of numbers, against param.
+func compareSize(v reflect.Value, param string, ok func(size, limit float64) bool, phrase string) error {
+	limit, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		// Tags are checked when parsed, so this only happens when a custom
+		// rule calls compareSize.
+		return fmt.Errorf("has an invalid rule parameter %q", param)
+	}
+	var size float64
+	unit := ""
+	switch v.Kind() {
+	case reflect.String:
+		size, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		size, unit = float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		size = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		size = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		size = v.Float()
+	default:
+		return fmt.Errorf("cannot be size-checked")
+	}
+	if ok(size, limit) {
+		return nil
+	}
+	if unit != "" {
+		return fmt.Errorf("must have %s %s%s", phrase, param, unit)
+	}
+	return fmt.Errorf("must be %s %s", phrase, param)
+}
+
+func checkNumberParam(param string) error {
+	if _, err := strconv.ParseFloat(param, 64); err != nil {
+		return fmt.Errorf("parameter %q is not a number", param)
+	}
+	return nil
+}
+
+func checkOneOfParam(param string) error {
+	if len(strings.Fields(param)) == 0 {
+		return errors.New("needs at least one option")
+	}
+	return nil
+}
+
+func validateEmail(v reflect.Value, _ string) error {
+	if v.Kind() == reflect.String {
+		addr, err := mail.ParseAddress(v.String())
+		if err == nil && addr.Address == v.String() {
+			return nil
+		}
+	}
+	return errors.New("must be a valid email address")
+}
+
+func validateURL(v reflect.Value, _ string) error {
+	if v.Kind() == reflect.String {
+		u, err := url.ParseRequestURI(v.String())
+		if err == nil && u.Scheme != "" && u.Host != "" {
+			return nil
+		}
+	}
+	return errors.New("must be a valid absolute URL")
+}
+
+func validateOneOf(v reflect.Value, param string) error {
+	options := strings.Fields(param)
+	value := fmt.Sprint(v.Interface())
+	for _, option := range options {
+		if value == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(options, ", "))
+}
+
+func isCollection(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Array, reflect.String:
+		return true
+	}
+	return false
+}
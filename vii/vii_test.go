@@ -2,10 +2,14 @@ package vii
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -140,6 +144,15 @@ func TestRequestHelpers(t *testing.T) {
 		}
 	})
 
+	t.Run("ReadJSON_NonPointer", func(t *testing.T) {
+		var i struct{}
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{}`))
+
+		if err := ReadJSON(req, i); err == nil {
+			t.Fatal("Expected error for non-pointer target, got nil")
+		}
+	})
+
 	t.Run("ReadJSON_WrongType", func(t *testing.T) {
 		type input struct {
 			Age int `json:"age"`
@@ -222,4 +235,287 @@ func TestURLPrimitive(t *testing.T) {
 			t.Errorf("Expected category to be empty, got '%s'", params["category"])
 		}
 	})
+
+	userURL := NewURL("/users/{id}/posts/{slug...}").WithQuery("page")
+
+	t.Run("Build_Path_Params", func(t *testing.T) {
+		builtURL, err := userURL.Resolve(Values{"id": "a b", "slug": "2024/hello world", "page": "2"})
+		if err != nil {
+			t.Fatalf("Resolve failed: %v", err)
+		}
+		expected := "/users/a%20b/posts/2024/hello%20world?page=2"
+		if builtURL != expected {
+			t.Errorf("Expected URL '%s', got '%s'", expected, builtURL)
+		}
+	})
+
+	t.Run("Build_Missing_Path_Param", func(t *testing.T) {
+		_, err := userURL.Resolve(Values{"slug": "hello"})
+		if err == nil {
+			t.Fatal("Expected error for missing path parameter, got nil")
+		}
+		if !strings.Contains(err.Error(), `"id"`) {
+			t.Errorf("Expected error to name the missing parameter, got '%v'", err)
+		}
+		if got := userURL.Build(Values{"slug": "hello"}); got != "/users/{id}/posts/hello" {
+			t.Errorf("Expected Build to keep the missing wildcard, got '%s'", got)
+		}
+	})
+
+	t.Run("Parse_Path_Params", func(t *testing.T) {
+		app := NewApp()
+		var params Values
+		app.Handle(userURL.Pattern("GET"), func(w http.ResponseWriter, r *http.Request) {
+			params = userURL.Parse(r)
+		})
+
+		req := httptest.NewRequest("GET", "/users/42/posts/2024/hello%20world?page=3", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+
+		if params["id"] != "42" {
+			t.Errorf("Expected id to be '42', got '%s'", params["id"])
+		}
+		if params["slug"] != "2024/hello world" {
+			t.Errorf("Expected slug to be '2024/hello world', got '%s'", params["slug"])
+		}
+		if params["page"] != "3" {
+			t.Errorf("Expected page to be '3', got '%s'", params["page"])
+		}
+	})
+}
+
+func TestNamedRoutes(t *testing.T) {
+	app := NewApp()
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+
+	app.Handle("GET /users/{id}", noop).Named("user")
+	api := app.Group("/api")
+	api.Handle("GET /posts/{slug}", noop).Named("api.post")
+
+	t.Run("URLFor", func(t *testing.T) {
+		got, err := app.URLFor("user", Values{"id": "7", "tab": "posts"})
+		if err != nil {
+			t.Fatalf("URLFor failed: %v", err)
+		}
+		if got != "/users/7?tab=posts" {
+			t.Errorf("Expected '/users/7?tab=posts', got '%s'", got)
+		}
+	})
+
+	t.Run("URLFor_Group_Prefix", func(t *testing.T) {
+		got, err := app.URLFor("api.post", Values{"slug": "hello"})
+		if err != nil {
+			t.Fatalf("URLFor failed: %v", err)
+		}
+		if got != "/api/posts/hello" {
+			t.Errorf("Expected '/api/posts/hello', got '%s'", got)
+		}
+	})
+
+	t.Run("URLFor_Unknown", func(t *testing.T) {
+		if _, err := app.URLFor("missing", nil); err == nil {
+			t.Error("Expected error for unknown route name, got nil")
+		}
+	})
+
+	t.Run("Template_urlFor", func(t *testing.T) {
+		mockFS := fstest.MapFS{
+			"link.html": {Data: []byte(`<a href="{{ urlFor "user" "id" .ID }}">me</a>`)},
+		}
+		if err := app.LoadTemplatesFS(mockFS, nil); err != nil {
+			t.Fatalf("LoadTemplatesFS failed: %v", err)
+		}
+		app.Handle("GET /link", func(w http.ResponseWriter, r *http.Request) {
+			if err := Render(w, r, "link.html", map[string]int{"ID": 3}); err != nil {
+				t.Errorf("Render failed: %v", err)
+			}
+		})
+
+		req := httptest.NewRequest("GET", "/link", nil)
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, req)
+
+		if w.Body.String() != `<a href="/users/3">me</a>` {
+			t.Errorf("Unexpected body '%s'", w.Body.String())
+		}
+	})
+}
+
+func TestRateLimiterConfig(t *testing.T) {
+	ctx := context.Background()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	t.Run("Headers", func(t *testing.T) {
+		handler := RateLimiter(RateLimiterConfig{Limit: 1, Window: time.Minute})(ok)
+		req := httptest.NewRequest("GET", "/", nil)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("Unexpected headers: %v", w.Header())
+		}
+		if w.Header().Get("RateLimit-Policy") != "1;w=60" {
+			t.Errorf("Expected policy '1;w=60', got '%s'", w.Header().Get("RateLimit-Policy"))
+		}
+
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("Expected status 429, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" || w.Header().Get("Retry-After") == "0" {
+			t.Errorf("Expected Retry-After, got '%s'", w.Header().Get("Retry-After"))
+		}
+	})
+
+	t.Run("KeyByHeader", func(t *testing.T) {
+		handler := RateLimiter(RateLimiterConfig{Limit: 1, KeyFunc: KeyByHeader("X-API-Key")})(ok)
+		for _, key := range []string{"a", "b"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-API-Key", key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected key %s to have its own bucket, got %d", key, w.Code)
+			}
+		}
+	})
+
+	t.Run("TrustedProxies", func(t *testing.T) {
+		handler := RateLimiter(RateLimiterConfig{Limit: 1, TrustedProxies: []string{"10.0.0.0/8"}})(ok)
+		for _, client := range []string{"203.0.113.1", "203.0.113.2"} {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "10.0.0.5:4321"
+			req.Header.Set("X-Forwarded-For", client+", 10.0.0.9")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected client %s behind the proxy to have its own bucket, got %d", client, w.Code)
+			}
+		}
+	})
+
+	t.Run("ClientIP", func(t *testing.T) {
+		trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+		if err != nil {
+			t.Fatalf("ParseTrustedProxies failed: %v", err)
+		}
+		cases := []struct {
+			remote, header, value, expected string
+		}{
+			{"[2001:db8::1]:443", "", "", "2001:db8::1"},
+			{"198.51.100.7:80", "X-Forwarded-For", "1.2.3.4", "198.51.100.7"},
+			{"10.1.1.1:80", "X-Forwarded-For", "1.2.3.4, 5.6.7.8", "5.6.7.8"},
+			{"[::1]:80", "Forwarded", `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]:4711"`, "2001:db8:cafe::17"},
+		}
+		for _, tc := range cases {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remote
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+			if got := ClientIP(req, trusted); got != tc.expected {
+				t.Errorf("ClientIP(%s, %s) = %s, expected %s", tc.remote, tc.value, got, tc.expected)
+			}
+		}
+	})
+
+	t.Run("TokenBucket", func(t *testing.T) {
+		now := time.Unix(1_000_000, 0)
+		store := NewMemoryStore(TokenBucket, 10)
+		store.now = func() time.Time { return now }
+		for i := 0; i < 2; i++ {
+			if res, _ := store.Allow(ctx, "k", 2, time.Second); !res.Allowed {
+				t.Fatalf("Expected request %d to be allowed", i+1)
+			}
+		}
+		res, _ := store.Allow(ctx, "k", 2, time.Second)
+		if res.Allowed || res.RetryAfter < 499*time.Millisecond || res.RetryAfter > 500*time.Millisecond {
+			t.Errorf("Expected denial with 500ms retry, got %+v", res)
+		}
+		now = now.Add(500 * time.Millisecond)
+		if res, _ := store.Allow(ctx, "k", 2, time.Second); !res.Allowed {
+			t.Error("Expected a token to have refilled")
+		}
+	})
+
+	t.Run("SlidingWindowEvictsIdleClients", func(t *testing.T) {
+		now := time.Unix(1_000_000, 0)
+		store := NewMemoryStore(SlidingWindow, 10)
+		store.now = func() time.Time { return now }
+		store.Allow(ctx, "idle", 5, time.Second)
+		now = now.Add(3 * time.Second)
+		store.Allow(ctx, "active", 5, time.Second)
+		if _, exists := store.clients["idle"]; exists {
+			t.Error("Expected idle client to be evicted")
+		}
+		if len(store.clients) != 1 {
+			t.Errorf("Expected 1 tracked client, got %d", len(store.clients))
+		}
+	})
+}
+
+func TestReadJSONWith(t *testing.T) {
+	type input struct {
+		Name  string `json:"name" validate:"required"`
+		Count any    `json:"count"`
+	}
+
+	newRequest := func(body, contentType string) *http.Request {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return req
+	}
+
+	t.Run("Options", func(t *testing.T) {
+		var i input
+		req := newRequest(`{"name":"vii","count":12345678901234567890,"extra":true}`, "application/json; charset=utf-8")
+		err := ReadJSONWith(req, httptest.NewRecorder(), &i, JSONOptions{AllowUnknownFields: true, UseNumber: true, RequireContentType: true})
+		if err != nil {
+			t.Fatalf("ReadJSONWith failed: %v", err)
+		}
+		if n, ok := i.Count.(json.Number); !ok || n.String() != "12345678901234567890" {
+			t.Errorf("Expected json.Number, got %T %v", i.Count, i.Count)
+		}
+	})
+
+	cases := []struct {
+		name        string
+		body        string
+		contentType string
+		opts        JSONOptions
+		status      int
+		field       string
+	}{
+		{"UnsupportedMediaType", `{}`, "text/plain", JSONOptions{RequireContentType: true}, http.StatusUnsupportedMediaType, ""},
+		{"TooLarge", `{"name":"` + strings.Repeat("a", 64) + `"}`, "", JSONOptions{MaxBytes: 16}, http.StatusRequestEntityTooLarge, ""},
+		{"UnknownField", `{"nope":1}`, "", JSONOptions{}, http.StatusBadRequest, "nope"},
+		{"WrongType", `{"name":5}`, "", JSONOptions{}, http.StatusBadRequest, "name"},
+		{"TrailingData", `{} {}`, "", JSONOptions{}, http.StatusBadRequest, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var i input
+			err := ReadJSONWith(newRequest(tc.body, tc.contentType), httptest.NewRecorder(), &i, tc.opts)
+			var bodyErr *BodyError
+			if !errors.As(err, &bodyErr) {
+				t.Fatalf("Expected *BodyError, got %v", err)
+			}
+			if bodyErr.Status != tc.status || bodyErr.Field != tc.field {
+				t.Errorf("Expected status %d field %q, got %d %q (%v)", tc.status, tc.field, bodyErr.Status, bodyErr.Field, bodyErr)
+			}
+		})
+	}
+
+	t.Run("Validate", func(t *testing.T) {
+		var i input
+		err := ReadJSONWith(newRequest(`{"name":""}`, ""), nil, &i, JSONOptions{Validate: true})
+		var errs ValidationErrors
+		if !errors.As(err, &errs) || errs[0].Field != "name" {
+			t.Errorf("Expected validation error for name, got %v", err)
+		}
+	})
 }
@@ -0,0 +1,509 @@
+package vii
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//=====================================
+// websockets (RFC 6455)
+//=====================================
+
+// Message types for Conn.ReadMessage and Conn.WriteMessage.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// Close codes defined by RFC 6455.
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseAbnormalClosure    = 1006
+	CloseInvalidPayloadData = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseInternalServerErr  = 1011
+)
+
+const (
+	continuationFrame = 0
+	websocketGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// ErrCloseSent is returned when writing to a Conn after its close frame
+// has been sent.
+var ErrCloseSent = errors.New("vii: websocket close already sent")
+
+// CloseError is returned by Conn.ReadMessage when the connection closes.
+// Code is CloseNoStatusReceived if the peer sent no code, and
+// CloseAbnormalClosure if the connection dropped without a close frame.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("websocket closed: %d", e.Code)
+}
+
+// WebSocketConfig holds the configuration for WebSocketWithConfig and
+// Upgrade.
+type WebSocketConfig struct {
+	// AllowOrigins lists the browser origins allowed to connect, in the
+	// format of CORSConfig.AllowOrigins. Requests without an Origin header,
+	// which do not come from browsers, are always allowed. When both
+	// AllowOrigins and CheckOrigin are empty only same-host origins are
+	// allowed, which guards against cross-site WebSocket hijacking.
+	AllowOrigins []string
+	// CheckOrigin, if set, is consulted for origins not matched by
+	// AllowOrigins.
+	CheckOrigin func(r *http.Request) bool
+	// Subprotocols lists the supported subprotocols in order of preference.
+	Subprotocols []string
+	// MaxMessageSize is the largest message, after reassembling fragments,
+	// that ReadMessage accepts. Larger messages close the connection with
+	// CloseMessageTooBig. Defaults to 1 MiB.
+	MaxMessageSize int64
+}
+
+// WebSocket registers a WebSocket endpoint with the default
+// WebSocketConfig. The pattern may omit the method, as the handshake is
+// always a GET. Middleware, including the app's and any group's, runs
+// before the upgrade, so it can reject the request with a normal response.
+// Timeout only limits the handshake: the upgrade lifts its deadline.
+func (app *App) WebSocket(pattern string, handler func(conn *Conn), middleware ...func(http.Handler) http.Handler) *Route {
+	return app.HandleErr(websocketPattern(pattern), WebSocketWithConfig(WebSocketConfig{}, handler), middleware...)
+}
+
+// WebSocket registers a WebSocket endpoint under the group's prefix. Group
+// middleware, such as authentication, runs before the upgrade.
+func (g *Group) WebSocket(pattern string, handler func(conn *Conn), middleware ...func(http.Handler) http.Handler) *Route {
+	return g.HandleErr(websocketPattern(pattern), WebSocketWithConfig(WebSocketConfig{}, handler), middleware...)
+}
+
+func websocketPattern(pattern string) string {
+	if method, path := splitPattern(pattern); method == "" {
+		return "GET " + path
+	}
+	return pattern
+}
+
+// WebSocketWithConfig returns a handler that upgrades the request and calls
+// handler with the connection, closing it when handler returns. Failed
+// handshakes are returned as HTTPErrors. Register it with App.HandleErr
+// or Group.HandleErr to customise the configuration.
+func WebSocketWithConfig(config WebSocketConfig, handler func(conn *Conn)) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		conn, err := Upgrade(w, r, config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		handler(conn)
+		return nil
+	}
+}
+
+// Upgrade performs the WebSocket handshake and takes over the connection.
+// It returns an HTTPError without writing a response if the request is not
+// a valid handshake (400, or 426 for an unsupported version) or its origin
+// is not allowed (403). The caller must Close the returned Conn.
+func Upgrade(w http.ResponseWriter, r *http.Request, config WebSocketConfig) (*Conn, error) {
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = 1 << 20
+	}
+
+	if r.Method != http.MethodGet {
+		return nil, NewHTTPError(http.StatusMethodNotAllowed, "WebSocket handshake must use GET")
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, NewHTTPError(http.StatusBadRequest, "Not a WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, NewHTTPError(http.StatusUpgradeRequired, "Unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, NewHTTPError(http.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+	}
+	if !websocketOriginAllowed(r, config) {
+		return nil, NewHTTPError(http.StatusForbidden, "Origin not allowed")
+	}
+
+	subprotocol := ""
+	offered := headerTokens(r.Header, "Sec-WebSocket-Protocol")
+	for _, supported := range config.Subprotocols {
+		if slices.Contains(offered, supported) {
+			subprotocol = supported
+			break
+		}
+	}
+
+	netConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("vii: websocket upgrade: %w", err)
+	}
+	// The server's read and write timeouts were meant for the HTTP exchange.
+	netConn.SetDeadline(time.Time{})
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n"
+	if subprotocol != "" {
+		response += "Sec-WebSocket-Protocol: " + subprotocol + "\r\n"
+	}
+	response += "\r\n"
+	if _, err := brw.WriteString(response); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if err := brw.Flush(); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return &Conn{
+		conn:           netConn,
+		br:             brw.Reader,
+		bw:             brw.Writer,
+		request:        r,
+		subprotocol:    subprotocol,
+		maxMessageSize: config.MaxMessageSize,
+	}, nil
+}
+
+func websocketOriginAllowed(r *http.Request, config WebSocketConfig) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(config.AllowOrigins) == 0 && config.CheckOrigin == nil {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	if parseOriginList(config.AllowOrigins).match(origin) {
+		return true
+	}
+	return config.CheckOrigin != nil && config.CheckOrigin(r)
+}
+
+// headerTokens splits the comma-separated values of a header.
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, value := range h.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, t := range headerTokens(h, name) {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a WebSocket connection. One goroutine may read while others
+// write; writes are serialised. Pings are answered automatically while
+// reading.
+type Conn struct {
+	conn           net.Conn
+	br             *bufio.Reader
+	bw             *bufio.Writer
+	request        *http.Request
+	subprotocol    string
+	maxMessageSize int64
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// Request returns the handshake request, for path values, headers and
+// anything middleware stored in its context.
+func (c *Conn) Request() *http.Request {
+	return c.request
+}
+
+// Subprotocol returns the negotiated subprotocol, or "" if none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// SetReadDeadline sets the deadline for ReadMessage; use it to drop idle
+// clients. A zero time means no deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage returns the next TextMessage or BinaryMessage, reassembling
+// fragments. Pings are answered and pongs discarded along the way. When the
+// peer closes the connection, its close frame is echoed and a *CloseError is
+// returned. Protocol violations close the connection with the matching code.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			var closeErr *CloseError
+			if errors.As(err, &closeErr) && closeErr.Code != CloseAbnormalClosure {
+				return 0, nil, c.fail(closeErr.Code, closeErr.Reason)
+			}
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err := c.writeFrame(PongMessage, payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			continue
+		case CloseMessage:
+			closeErr, ok := parseCloseFrame(payload)
+			if !ok {
+				return 0, nil, c.fail(CloseProtocolError, "invalid close frame")
+			}
+			code := closeErr.Code
+			if code == CloseNoStatusReceived {
+				code = CloseNormalClosure
+			}
+			c.writeClose(code, "")
+			c.conn.Close()
+			return 0, nil, closeErr
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = opcode
+		case continuationFrame:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		if int64(len(message))+int64(len(payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, "message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			if messageType == TextMessage && !utf8.Valid(message) {
+				return 0, nil, c.fail(CloseInvalidPayloadData, "invalid UTF-8")
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// WriteMessage sends data as a single TextMessage or BinaryMessage frame,
+// or as a control frame for PingMessage and PongMessage.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	switch messageType {
+	case TextMessage, BinaryMessage, PingMessage, PongMessage:
+	default:
+		return fmt.Errorf("vii: invalid websocket message type %d", messageType)
+	}
+	return c.writeFrame(messageType, data)
+}
+
+// Ping sends a ping; the peer's pong is discarded by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(PingMessage, data)
+}
+
+// Close sends a normal close frame, if none has been sent, and closes the
+// connection.
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormalClosure, "")
+}
+
+// CloseWithCode sends a close frame with code and reason, if none has been
+// sent, and closes the connection.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	c.writeClose(code, reason)
+	return c.conn.Close()
+}
+
+// fail closes the connection after a protocol violation.
+func (c *Conn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	c.conn.Close()
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func (c *Conn) writeClose(code int, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	c.writeFrame(CloseMessage, payload)
+}
+
+// readFrame reads a single frame and unmasks its payload. Violations of
+// the framing rules are returned as CloseErrors carrying the code to close
+// with.
+func (c *Conn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return false, 0, nil, readError(err)
+	}
+	fin = header[0]&0x80 != 0
+	opcode = int(header[0] & 0x0f)
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "client frames must be masked"}
+	}
+
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, readError(err)
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, readError(err)
+		}
+		if ext[0]&0x80 != 0 {
+			return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "invalid payload length"}
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if opcode >= CloseMessage {
+		if !fin || length > 125 {
+			return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+		}
+	} else if length > c.maxMessageSize {
+		return false, 0, nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, readError(err)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, readError(err)
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// readError reports a dropped connection as an abnormal closure and passes
+// other errors, such as deadlines, through.
+func readError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return &CloseError{Code: CloseAbnormalClosure}
+	}
+	return err
+}
+
+// parseCloseFrame decodes the code and reason of a close frame payload,
+// reporting false if the payload is malformed.
+func parseCloseFrame(payload []byte) (*CloseError, bool) {
+	if len(payload) == 0 {
+		return &CloseError{Code: CloseNoStatusReceived}, true
+	}
+	if len(payload) == 1 {
+		return nil, false
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+	if !validCloseCode(code) || !utf8.Valid(reason) {
+		return nil, false
+	}
+	return &CloseError{Code: code, Reason: string(reason)}, true
+}
+
+// validCloseCode reports whether a peer may send code in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// writeFrame writes an unmasked, unfragmented frame. After a close frame
+// has been written, further writes fail with ErrCloseSent.
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	if opcode >= CloseMessage && len(payload) > 125 {
+		return errors.New("vii: websocket control frame payload exceeds 125 bytes")
+	}
+	if opcode == CloseMessage {
+		c.closeSent = true
+	}
+
+	header := []byte{0x80 | byte(opcode)}
+	switch n := len(payload); {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := c.bw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.bw.Write(payload); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
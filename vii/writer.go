@@ -0,0 +1,71 @@
+package vii
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// responseWriter wraps an http.ResponseWriter to record the status code and
+// the number of body bytes written. Unwrap exposes the original writer so
+// http.ResponseController can still reach Flush, Hijack and deadlines.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	// Informational responses (other than 101) may be followed by another
+	// status, so they don't count as the final header.
+	if !rw.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		rw.status = code
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	rw.FlushError()
+}
+
+// FlushError flushes the underlying writer, returning http.ErrNotSupported
+// without writing the header if it cannot flush.
+func (rw *responseWriter) FlushError() error {
+	if !canFlush(rw.ResponseWriter) {
+		return http.ErrNotSupported
+	}
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return http.NewResponseController(rw.ResponseWriter).Flush()
+}
+
+// Hijack hands over the connection, recording a protocol upgrade such as a
+// WebSocket handshake as status 101.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil && !rw.wroteHeader {
+		rw.status = http.StatusSwitchingProtocols
+		rw.wroteHeader = true
+	}
+	return conn, brw, err
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}